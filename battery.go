@@ -0,0 +1,72 @@
+package main
+
+import "regexp"
+
+// batteryEncoding describes how a sensor reports the state of its battery.
+type batteryEncoding int
+
+const (
+	// batteryBinary fields are 0 when the battery is ok and 1 when it is low.
+	batteryBinary batteryEncoding = iota
+	// batteryVoltage fields are the battery voltage, which is low at or below the threshold.
+	batteryVoltage
+	// batteryLevel fields are a level from 0 to 5 where 1 or less is low and 6 means the sensor is on external power.
+	batteryLevel
+)
+
+// batteryLowGauge is the gauge that every battery field is normalised to, 1 when the battery is low and 0 otherwise.
+const batteryLowGauge = "sensor_battery_low"
+
+// batteryLowLevel is the level at or below which a batteryLevel sensor is considered low.
+const batteryLowLevel = 1
+
+// batterySensor describes the battery field of one type of sensor. The sensor is a template expanded with the
+// submatches of the pattern to become the sensor label.
+type batterySensor struct {
+	pattern   *regexp.Regexp
+	sensor    string
+	encoding  batteryEncoding
+	threshold float64
+}
+
+// batterySensors is the lookup of how each ecowitt battery field encodes its value:
+//
+//   - binary: wh24batt, wh25batt, wh26batt, wh65batt, and the WH31 batt1..8 / wh31batt1..8 channels
+//   - voltage: wh40batt (rain), wh68batt (anemometer), wh80batt and wh90batt (ultrasonic arrays), soilbatt1..8 (WH51),
+//     tf_batt1..8 (WN34), and leafbatt1..8 (WN35)
+//   - level: wh57batt (lightning), pm25batt1..4 (WH41), leakbatt1..4 (WH55), and co2_batt (WH45)
+var batterySensors = []batterySensor{
+	{pattern: regexp.MustCompile(`^(wh2[456]|wh65)batt$`), sensor: "$1", encoding: batteryBinary},
+	{pattern: regexp.MustCompile(`^(?:wh31)?batt([1-8])$`), sensor: "wh31_ch$1", encoding: batteryBinary},
+	{pattern: regexp.MustCompile(`^wh40batt$`), sensor: "wh40", encoding: batteryVoltage, threshold: 1.2},
+	{pattern: regexp.MustCompile(`^wh68batt$`), sensor: "wh68", encoding: batteryVoltage, threshold: 1.2},
+	{pattern: regexp.MustCompile(`^(wh80|wh90)batt$`), sensor: "$1", encoding: batteryVoltage, threshold: 2.4},
+	{pattern: regexp.MustCompile(`^soilbatt([1-8])$`), sensor: "wh51_ch$1", encoding: batteryVoltage, threshold: 1.2},
+	{pattern: regexp.MustCompile(`^tf_batt([1-8])$`), sensor: "wn34_ch$1", encoding: batteryVoltage, threshold: 1.2},
+	{pattern: regexp.MustCompile(`^leafbatt([1-8])$`), sensor: "wn35_ch$1", encoding: batteryVoltage, threshold: 1.2},
+	{pattern: regexp.MustCompile(`^wh57batt$`), sensor: "wh57", encoding: batteryLevel},
+	{pattern: regexp.MustCompile(`^pm25batt([1-4])$`), sensor: "wh41_ch$1", encoding: batteryLevel},
+	{pattern: regexp.MustCompile(`^leakbatt([1-4])$`), sensor: "wh55_ch$1", encoding: batteryLevel},
+	{pattern: regexp.MustCompile(`^co2_batt$`), sensor: "wh45", encoding: batteryLevel},
+}
+
+// batteryLow returns the sensor label for a battery field and whether its value indicates a low battery. The final
+// return value is false when the field is not a known battery field.
+func batteryLow(key string, value float64) (string, bool, bool) {
+	for _, b := range batterySensors {
+		m := b.pattern.FindStringSubmatchIndex(key)
+		if m == nil {
+			continue
+		}
+		sensor := string(b.pattern.ExpandString(nil, b.sensor, key, m))
+		switch b.encoding {
+		case batteryVoltage:
+			return sensor, value <= b.threshold, true
+		case batteryLevel:
+			return sensor, value <= batteryLowLevel, true
+		default:
+			return sensor, value >= 1, true
+		}
+	}
+	return "", false, false
+}
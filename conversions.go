@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+)
+
+const (
+	// mphToMps converts miles per hour to metres per second.
+	mphToMps = 0.44704
+	// inHgToHpa converts inches of mercury to hectopascals.
+	inHgToHpa = 33.8639
+	// inchToMm converts inches to millimetres.
+	inchToMm = 25.4
+	// luxPerWm2 is the approximate illuminance in lux of one W/m2 of sunlight. The true ratio depends on the spectrum
+	// of the light so it varies with solar elevation, cloud cover, and the sensor itself, which makes converted values
+	// an estimate that is only reasonable for direct daylight.
+	luxPerWm2 = 126.7
+	// mileToKm converts miles to kilometres.
+	mileToKm = 1.609344
+)
+
+const (
+	solarUnitWm2 = "wm2"
+	solarUnitLux = "lux"
+)
+
+const (
+	distanceUnitKm = "km"
+	distanceUnitMi = "mi"
+)
+
+// lightningDistanceGauge and lightningStrikesCounter hold the distance of the latest lightning strike and the number
+// of strikes counted from the increases of lightning_num.
+const (
+	lightningDistanceGauge  = "lightning_distance_km"
+	lightningStrikesCounter = "lightning_strikes_total"
+)
+
+// fahrenheitFieldPattern and humidityFieldPattern match the outdoor (tempf, humidity), indoor (tempinf, humidityin),
+// and per channel WH31 (temp1f..temp8f, humidity1..humidity8) sensors. The submatch identifies the channel.
+var (
+	fahrenheitFieldPattern = regexp.MustCompile(`^temp(in|[1-8])?f$`)
+	humidityFieldPattern   = regexp.MustCompile(`^humidity(in|[1-8])?$`)
+)
+
+const (
+	// temperatureGauge and humidityGauge are the channelized gauges that every temperature and humidity sensor is
+	// emitted to, distinguished by the channel label.
+	temperatureGauge = "temp_celsius"
+	humidityGauge    = "humidity_percent"
+)
+
+// rainFieldPattern matches the rain rate and accumulated rainfall fields that are reported in inches.
+var rainFieldPattern = regexp.MustCompile(`^(rainrate|(?:event|hourly|daily|weekly|monthly|yearly|total)rain)in$`)
+
+// windSpeedFields maps the known wind speed fields reported in miles per hour to the name of their metres per second
+// gauge. Any other *mph field is only emitted as a raw gauge.
+var windSpeedFields = map[string]string{
+	"windspeedmph":      "windspeed_mps",
+	"windgustmph":       "windgust_mps",
+	"maxdailygust":      "maxdailygust_mps",
+	"windspdmph_avg10m": "windspd_avg10m_mps",
+}
+
+// pressureFields maps the barometric pressure fields reported in inches of mercury to the name of their hPa gauge.
+var pressureFields = map[string]string{
+	"baromrelin": "barom_rel_hpa",
+	"baromabsin": "barom_abs_hpa",
+}
+
+// compassFields maps the wind direction fields reported in degrees to the name of their compass sector gauge.
+var compassFields = map[string]string{
+	"winddir":        "wind_compass",
+	"winddir_avg10m": "wind_avg10m_compass",
+}
+
+// compassPoints are the 16 compass sectors in clockwise order starting from north.
+var compassPoints = [...]string{
+	"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW",
+}
+
+// convertField returns the name and value of the unit converted gauge that should be emitted alongside the raw gauge
+// for the given field. Temperature and humidity are handled separately by sensorChannel. The final return value is
+// false when the field has no known conversion.
+func convertField(key string, value float64) (string, float64, bool) {
+	if name, ok := millimetreField(key); ok {
+		return name, value * inchToMm, true
+	}
+	if name, ok := windSpeedFields[key]; ok {
+		return name, value * mphToMps, true
+	}
+	if name, ok := pressureFields[key]; ok {
+		return name, value * inHgToHpa, true
+	}
+	if key == "uv" {
+		return "uv_index", value, true
+	}
+	return "", 0, false
+}
+
+// normalizeHumidityFraction converts a humidity field value that was reported as a fraction into a percentage. The
+// final return value is false when the field is not a humidity field or the value already looks like a percentage.
+// Zero is left alone since it is the same either way.
+func normalizeHumidityFraction(key string, value float64) (float64, bool) {
+	if !strings.HasPrefix(key, "humidity") || value <= 0 || value > 1 {
+		return value, false
+	}
+	return value * 100, true
+}
+
+// temperatureChannel returns the channel label for a fahrenheit temperature field.
+func temperatureChannel(key string) (string, bool) {
+	return sensorChannel(fahrenheitFieldPattern, key)
+}
+
+// humidityChannel returns the channel label for a relative humidity field.
+func humidityChannel(key string) (string, bool) {
+	return sensorChannel(humidityFieldPattern, key)
+}
+
+// sensorChannel maps the channel submatch of a sensor field to its channel label: "outdoor" for the base sensor,
+// "indoor" for the in suffix, or the WH31 channel number.
+func sensorChannel(pattern *regexp.Regexp, key string) (string, bool) {
+	m := pattern.FindStringSubmatch(key)
+	if m == nil {
+		return "", false
+	}
+	switch m[1] {
+	case "":
+		return "outdoor", true
+	case "in":
+		return "indoor", true
+	default:
+		return m[1], true
+	}
+}
+
+// rainTotalPattern matches the accumulated rainfall fields that only increase until the station resets them. The
+// submatch is the period that they accumulate over. The hourly rain is excluded since it is a rolling total.
+var rainTotalPattern = regexp.MustCompile(`^(event|daily|weekly|monthly|yearly|total)rainin$`)
+
+// rainTotalPeriod returns the accumulation period of a rain total field.
+func rainTotalPeriod(key string) (string, bool) {
+	if m := rainTotalPattern.FindStringSubmatch(key); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
+
+// millimetreField returns the name of the millimetre gauge to emit for a rainfall field reported in inches.
+func millimetreField(key string) (string, bool) {
+	if m := rainFieldPattern.FindStringSubmatch(key); m != nil {
+		return m[1] + "_mm", true
+	}
+	return "", false
+}
+
+// solarRadiationWm2 normalises a solarradiation value reported in the given unit to W/m2.
+func solarRadiationWm2(value float64, unit string) float64 {
+	if unit == solarUnitLux {
+		return value / luxPerWm2
+	}
+	return value
+}
+
+// lightningDistanceKm normalises a lightning distance reported in the given unit to kilometres.
+func lightningDistanceKm(value float64, unit string) float64 {
+	if unit == distanceUnitMi {
+		return value * mileToKm
+	}
+	return value
+}
+
+// roundToPlaces rounds the value to the number of decimal places with halves rounded away from zero, so -2.5 rounds
+// to -3 at 0 places. Values that are not exactly representable round according to their binary value, so 1.005 rounds
+// to 1 at 2 places.
+func roundToPlaces(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	rounded := math.Round(value*scale) / scale
+	if math.IsInf(rounded, 0) || math.IsNaN(rounded) {
+		return value
+	}
+	return rounded
+}
+
+func fahrenheitToCelsius(value float64) float64 {
+	return (value - 32) * 5 / 9
+}
+
+// compassSector returns the index (0-15) and name of the 16 point compass sector that the direction in degrees falls
+// in. Each sector is 22.5 degrees wide and centred on its compass point so north covers [348.75, 11.25).
+func compassSector(degrees float64) (int, string) {
+	const width = 360.0 / float64(len(compassPoints))
+	normalised := math.Mod(degrees+width/2, 360)
+	if normalised < 0 {
+		normalised += 360
+	}
+	sector := int(normalised/width) % len(compassPoints)
+	return sector, compassPoints[sector]
+}
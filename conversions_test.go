@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompassSectorBoundaries(t *testing.T) {
+	const width = 22.5
+	for i, point := range compassPoints {
+		// each sector starts half a sector before its compass point and ends just before the next one starts
+		start := float64(i)*width - width/2
+		if start < 0 {
+			start += 360
+		}
+		for _, degrees := range []float64{start, float64(i) * width, start + width - 0.001} {
+			if sector, name := compassSector(degrees); sector != i || name != point {
+				t.Errorf("compassSector(%v): expected %d %s, got %d %s", degrees, i, point, sector, name)
+			}
+		}
+	}
+}
+
+func TestCompassSectorWraparound(t *testing.T) {
+	for _, tc := range []struct {
+		degrees  float64
+		expected string
+	}{
+		{0, "N"},
+		{360, "N"},
+		{359.999, "N"},
+		{348.75, "N"},
+		{348.749, "NNW"},
+		{11.249, "N"},
+		{11.25, "NNE"},
+		{720, "N"},
+		{-10, "N"},
+		{-20, "NNW"},
+	} {
+		if _, name := compassSector(tc.degrees); name != tc.expected {
+			t.Errorf("compassSector(%v): expected %s, got %s", tc.degrees, tc.expected, name)
+		}
+	}
+}
+
+func TestRoundToPlaces(t *testing.T) {
+	for _, tc := range []struct {
+		value    float64
+		places   int
+		expected float64
+	}{
+		{23.0000000001, 1, 23},
+		{21.11111111111111, 2, 21.11},
+		{-17.77777777777778, 2, -17.78},
+		{-0.04, 1, -0},
+		// exact halves round away from zero
+		{2.5, 0, 3},
+		{-2.5, 0, -3},
+		{0.125, 2, 0.13},
+		{-0.125, 2, -0.13},
+		{1.25, 1, 1.3},
+		{-1.25, 1, -1.3},
+		// 1.005 is slightly below the half in binary
+		{1.005, 2, 1},
+		{1013.2467, 0, 1013},
+		// values too large to scale are returned unchanged
+		{1e300, 15, 1e300},
+	} {
+		if actual := roundToPlaces(tc.value, tc.places); actual != tc.expected {
+			t.Errorf("roundToPlaces(%v, %d): expected %v, got %v", tc.value, tc.places, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+)
+
+// cumulativeFieldPattern matches the report fields that accumulate until the station resets them, such as the rain
+// totals at the start of each day, week, month, or year, and the daily lightning strike count.
+var cumulativeFieldPattern = regexp.MustCompile(`^((?:event|daily|weekly|monthly|yearly|total)rainin|lightning_num)$`)
+
+// cumulativeTracker remembers the previous value of each cumulative field of each station so that resets can be
+// detected. The memory used is bounded by the number of stations and cumulative fields. The zero value is ready to
+// use.
+type cumulativeTracker struct {
+	lock     sync.Mutex
+	previous map[string]float64
+}
+
+// observe records the latest value of the series identified by key and returns the value it replaced, the final
+// return value is false for the first observation of the series. A negative value is recorded as 0 so that the
+// increase from it to the next reading is not overcounted.
+func (t *cumulativeTracker) observe(key string, value float64) (float64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.previous == nil {
+		t.previous = make(map[string]float64)
+	}
+	previous, ok := t.previous[key]
+	if value < 0 {
+		value = 0
+	}
+	t.previous[key] = value
+	return previous, ok
+}
+
+// cumulativeDelta returns how much a cumulative field increased by since its previous value. The first reading only
+// establishes the baseline, and after a reset the new reading is all new. A negative reading after a reset adds
+// nothing, since a prometheus counter cannot decrease.
+func cumulativeDelta(previous float64, hasPrevious bool, value float64) float64 {
+	switch {
+	case !hasPrevious:
+		return 0
+	case value < previous:
+		if value < 0 {
+			return 0
+		}
+		return value
+	default:
+		return value - previous
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedPasskey replaces the passkey in the reports shown by the debug endpoint.
+const redactedPasskey = "REDACTED"
+
+// lastReport is the most recent report received from a source ip as shown by the debug endpoint.
+type lastReport struct {
+	ReceivedAt time.Time  `json:"receivedAt"`
+	Body       string     `json:"body"`
+	Fields     url.Values `json:"fields"`
+}
+
+// lastReports keeps only the latest report from each source ip so that the memory used is bounded by the number of
+// stations rather than the number of reports.
+type lastReports struct {
+	lock    sync.Mutex
+	reports map[string]lastReport
+}
+
+func newLastReports() *lastReports {
+	return &lastReports{reports: make(map[string]lastReport)}
+}
+
+// record stores the raw body and parsed fields of a report, replacing any earlier report from the same source ip. The
+// passkey is redacted from both.
+func (l *lastReports) record(sourceIp string, body []byte, values url.Values) {
+	fields := make(url.Values, len(values))
+	for k, v := range values {
+		fields[k] = append([]string(nil), v...)
+	}
+	raw := string(body)
+	if passkey := values.Get("PASSKEY"); passkey != "" {
+		raw = strings.ReplaceAll(raw, passkey, redactedPasskey)
+		fields.Set("PASSKEY", redactedPasskey)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.reports[sourceIp] = lastReport{ReceivedAt: time.Now(), Body: raw, Fields: fields}
+}
+
+// ServeHTTP writes the latest report from each source ip as a json object keyed by source ip.
+func (l *lastReports) ServeHTTP(writer http.ResponseWriter, _ *http.Request) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	// the raw bodies are url encoded so leave the & characters readable
+	encoder.SetEscapeHTML(false)
+	l.lock.Lock()
+	err := encoder.Encode(l.reports)
+	l.lock.Unlock()
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_, _ = writer.Write(buf.Bytes())
+}
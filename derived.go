@@ -0,0 +1,200 @@
+package main
+
+import "math"
+
+const (
+	// tetensA, tetensB, and tetensC are the Tetens equation coefficients for the saturation vapour pressure in kPa
+	// over a water surface.
+	tetensA = 0.61078
+	tetensB = 17.27
+	tetensC = 237.3
+
+	// waterVaporGramsKelvinPerJoule is the reciprocal of the specific gas constant of water vapour, in g.K/J, which
+	// converts a vapour pressure in Pa into a density in g/m3 with the ideal gas law.
+	waterVaporGramsKelvinPerJoule = 2.1674
+
+	// heatIndexThresholdF is the temperature below which the heat index is not meaningfully different from the air
+	// temperature and the heat_index gauge reports the air temperature instead.
+	heatIndexThresholdF = 80
+
+	// cloudBaseMetresPerDegree is how far the cloud base rises for every degree celsius of spread between the
+	// temperature and dew point, the common 400ft per degree rule of thumb.
+	cloudBaseMetresPerDegree = 400 * 0.3048
+
+	// wetBulbMinHumidity and wetBulbMaxHumidity bound the relative humidity over which the Stull approximation is
+	// accurate.
+	wetBulbMinHumidity = 5
+	wetBulbMaxHumidity = 99
+
+	// windChillMaxTempF and windChillMinWindMph bound the conditions under which the NWS wind chill formula is valid.
+	windChillMaxTempF   = 50
+	windChillMinWindMph = 3
+)
+
+// climateSensors lists the temperature and humidity field pairs that derived metrics are computed from along with the
+// infix used in the names of the derived gauges. Metrics that only make sense outside are limited to the outdoor
+// sensor.
+var climateSensors = []struct {
+	temperature, humidity, infix string
+	outdoor                      bool
+}{
+	{temperature: "tempf", humidity: "humidity", infix: "", outdoor: true},
+	{temperature: "tempinf", humidity: "humidityin", infix: "_indoor"},
+}
+
+// deriveMetrics computes the derived gauges that can be calculated from the parsed fields of a single report. Gauges
+// whose inputs are missing from the report are not returned.
+func deriveMetrics(fields map[string]float64) map[string]float64 {
+	derived := make(map[string]float64)
+	for _, sensor := range climateSensors {
+		tempF, hasTemp := fields[sensor.temperature]
+		if !hasTemp {
+			continue
+		}
+		tempC := fahrenheitToCelsius(tempF)
+		saturation := saturationVaporPressure(tempC)
+		derived["saturation_vapor_pressure"+sensor.infix+"_kpa"] = saturation
+
+		humidity, hasHumidity := fields[sensor.humidity]
+		if !hasHumidity || humidity <= 0 {
+			continue
+		}
+		actual := actualVaporPressure(tempC, humidity)
+		derived["actual_vapor_pressure"+sensor.infix+"_kpa"] = actual
+		derived["vapor_pressure_deficit"+sensor.infix+"_kpa"] = saturation - actual
+		dewPointC := dewPoint(tempC, humidity)
+		derived["dewpoint"+sensor.infix+"_celsius"] = dewPointC
+		derived["absolute_humidity"+sensor.infix+"_grams_per_m3"] = absoluteHumidity(tempC, humidity)
+		if sensor.outdoor {
+			derived["cloud_base_meters"] = cloudBase(tempC, dewPointC)
+			if humidity >= wetBulbMinHumidity && humidity <= wetBulbMaxHumidity {
+				derived["wet_bulb_celsius"] = wetBulb(tempC, humidity)
+			}
+		}
+	}
+
+	if tempF, humidity, ok := outdoorClimate(fields); ok {
+		if tempF >= heatIndexThresholdF {
+			derived["heat_index_celsius"] = fahrenheitToCelsius(heatIndex(tempF, humidity))
+		} else {
+			derived["heat_index_celsius"] = fahrenheitToCelsius(tempF)
+		}
+	}
+
+	if tempF, ok := fields["tempf"]; ok {
+		windMph := fields["windspeedmph"]
+		if chill, ok := windChill(tempF, windMph); ok {
+			derived["wind_chill_celsius"] = fahrenheitToCelsius(chill)
+		}
+		humidity, hasHumidity := fields["humidity"]
+		derived["feels_like_celsius"] = fahrenheitToCelsius(feelsLike(tempF, windMph, humidity, hasHumidity))
+	}
+	return derived
+}
+
+// saturationVaporPressure returns the saturation vapour pressure in kPa over water at a temperature in celsius using
+// the Tetens equation. The dew point and absolute humidity are both built on this so that they agree with each other.
+func saturationVaporPressure(tempC float64) float64 {
+	return tetensA * math.Exp(tetensB*tempC/(tempC+tetensC))
+}
+
+// actualVaporPressure returns the partial pressure of water vapour in kPa for a temperature in celsius and a relative
+// humidity percentage.
+func actualVaporPressure(tempC, humidity float64) float64 {
+	return saturationVaporPressure(tempC) * humidity / 100
+}
+
+// dewPoint returns the dew point in celsius for a temperature in celsius and a relative humidity percentage. It is the
+// temperature at which the actual vapour pressure would be saturated, found by inverting the Tetens equation.
+func dewPoint(tempC, humidity float64) float64 {
+	gamma := math.Log(actualVaporPressure(tempC, humidity) / tetensA)
+	return tetensC * gamma / (tetensB - gamma)
+}
+
+// cloudBase returns the approximate height in metres above the station of the base of cumulus clouds from the spread
+// between the temperature and dew point in celsius. This is only an estimate that assumes a well mixed lower atmosphere
+// and does not apply to stable layers, fog, or clouds that have formed elsewhere.
+func cloudBase(tempC, dewPointC float64) float64 {
+	return (tempC - dewPointC) * cloudBaseMetresPerDegree
+}
+
+// wetBulb returns the wet-bulb temperature in celsius for a temperature in celsius and a relative humidity percentage
+// using the Stull (2011) approximation, see https://doi.org/10.1175/JAMC-D-11-0143.1. The approximation is only valid
+// for relative humidity between 5% and 99% and temperatures between -20C and 50C.
+func wetBulb(tempC, humidity float64) float64 {
+	return tempC*math.Atan(0.151977*math.Sqrt(humidity+8.313659)) +
+		math.Atan(tempC+humidity) -
+		math.Atan(humidity-1.676331) +
+		0.00391838*math.Pow(humidity, 1.5)*math.Atan(0.023101*humidity) -
+		4.686035
+}
+
+// absoluteHumidity returns the mass of water vapour in grams per cubic metre of air for a temperature in celsius and a
+// relative humidity percentage. The actual vapour pressure is converted to a density with the ideal gas law for water
+// vapour.
+func absoluteHumidity(tempC, humidity float64) float64 {
+	return actualVaporPressure(tempC, humidity) * 1000 * waterVaporGramsKelvinPerJoule / (273.15 + tempC)
+}
+
+// feelsLike returns the apparent temperature in fahrenheit following the common convention of picking whichever of
+// the wind chill or heat index applies to the conditions:
+//
+//   - the wind chill when the temperature is at or below 50F and the wind is above 3mph, see windChill
+//   - the heat index when the temperature is at or above 80F and the humidity is known, see heatIndexThresholdF
+//   - the air temperature otherwise
+//
+// The two ranges never overlap so at most one adjustment is made. A missing wind speed should be passed as 0.
+func feelsLike(tempF, windMph, humidity float64, hasHumidity bool) float64 {
+	if chill, ok := windChill(tempF, windMph); ok {
+		return chill
+	}
+	if hasHumidity && tempF >= heatIndexThresholdF {
+		return heatIndex(tempF, humidity)
+	}
+	return tempF
+}
+
+// outdoorClimate returns the outdoor temperature in fahrenheit and relative humidity if both are present in the report.
+func outdoorClimate(fields map[string]float64) (float64, float64, bool) {
+	tempF, hasTemp := fields["tempf"]
+	humidity, hasHumidity := fields["humidity"]
+	return tempF, humidity, hasTemp && hasHumidity
+}
+
+// heatIndex returns the heat index in fahrenheit using the NWS Rothfusz regression, see
+// https://www.wpc.ncep.noaa.gov/html/heatindex_equation.shtml. The simpler Steadman approximation is used when its
+// result is below 80F since the regression is not valid there.
+func heatIndex(tempF, humidity float64) float64 {
+	simple := 0.5 * (tempF + 61.0 + (tempF-68.0)*1.2 + humidity*0.094)
+	if (simple+tempF)/2 < 80 {
+		return simple
+	}
+
+	hi := -42.379 +
+		2.04901523*tempF +
+		10.14333127*humidity -
+		0.22475541*tempF*humidity -
+		0.00683783*tempF*tempF -
+		0.05481717*humidity*humidity +
+		0.00122874*tempF*tempF*humidity +
+		0.00085282*tempF*humidity*humidity -
+		0.00000199*tempF*tempF*humidity*humidity
+
+	if humidity < 13 && tempF >= 80 && tempF <= 112 {
+		hi -= ((13 - humidity) / 4) * math.Sqrt((17-math.Abs(tempF-95))/17)
+	} else if humidity > 85 && tempF >= 80 && tempF <= 87 {
+		hi += ((humidity - 85) / 10) * ((87 - tempF) / 5)
+	}
+	return hi
+}
+
+// windChill returns the wind chill in fahrenheit using the NWS formula, see
+// https://www.weather.gov/media/epz/wxcalc/windChill.pdf. The final return value is false when the temperature or wind
+// speed is outside the range for which the formula is valid.
+func windChill(tempF, windMph float64) (float64, bool) {
+	if tempF > windChillMaxTempF || windMph <= windChillMinWindMph {
+		return 0, false
+	}
+	v := math.Pow(windMph, 0.16)
+	return 35.74 + 0.6215*tempF - 35.75*v + 0.4275*tempF*v, true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// assertApprox fails the test when the actual value is further than the tolerance from the expected value.
+func assertApprox(t *testing.T, name string, expected, actual, tolerance float64) {
+	t.Helper()
+	if math.Abs(expected-actual) > tolerance {
+		t.Errorf("%s: expected %v within %v, got %v", name, expected, tolerance, actual)
+	}
+}
+
+func TestAbsoluteHumidity(t *testing.T) {
+	// reference densities of saturated air over water, scaled by the relative humidity
+	for _, tc := range []struct {
+		tempC, humidity, expected float64
+	}{
+		{0, 100, 4.85},
+		{20, 100, 17.3},
+		{30, 100, 30.4},
+		{20, 50, 8.65},
+		{-10, 80, 1.89},
+		{35, 40, 15.8},
+	} {
+		assertApprox(t, "absoluteHumidity", tc.expected, absoluteHumidity(tc.tempC, tc.humidity), tc.expected*0.01)
+	}
+}
+
+func TestWetBulb(t *testing.T) {
+	// the worked example from Stull (2011)
+	assertApprox(t, "wetBulb", 13.7, wetBulb(20, 50), 0.05)
+
+	// psychrometric values at sea level pressure, which Stull reports the approximation is within -1C to +0.65C of
+	for _, tc := range []struct {
+		tempC, humidity, expected float64
+	}{
+		{25, 60, 19.5},
+		{30, 40, 20.2},
+		{10, 90, 9.0},
+		{35, 70, 30.0},
+		{0, 50, -3.5},
+	} {
+		assertApprox(t, "wetBulb", tc.expected, wetBulb(tc.tempC, tc.humidity), 1)
+	}
+}
+
+func TestFeelsLike(t *testing.T) {
+	for _, tc := range []struct {
+		name                     string
+		tempF, windMph, humidity float64
+		hasHumidity              bool
+		expected, tolerance      float64
+	}{
+		{"wind chill needs wind above 3mph", 50, 3, 50, true, 50, 0},
+		{"wind chill just above 3mph", 50, 3.1, 50, true, 49.59, 0.01},
+		{"wind chill at 50F", 50, 5, 50, true, 48, 0.5},
+		{"no wind chill above 50F", 50.1, 10, 50, true, 50.1, 0},
+		{"wind chill table", 40, 10, 50, true, 34, 0.5},
+		{"no heat index below 80F", 79.9, 0, 90, true, 79.9, 0},
+		{"heat index at 80F", 80, 0, 40, true, 79.58, 0.01},
+		{"heat index table", 90, 0, 60, true, 100, 0.5},
+		{"no heat index without humidity", 90, 0, 0, false, 90, 0},
+		{"air temperature between the ranges", 65, 20, 50, true, 65, 0},
+	} {
+		assertApprox(t, tc.name, tc.expected, feelsLike(tc.tempF, tc.windMph, tc.humidity, tc.hasHumidity), tc.tolerance)
+	}
+}
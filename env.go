@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configEnvVar is an environment variable that overrides a config field.
+type configEnvVar struct {
+	name  string
+	field string
+	apply func(c *Config, value string) error
+}
+
+// configEnvVars are the environment variables that override the config file. The precedence of each value is
+// flag > environment > config file > default.
+var configEnvVars = []configEnvVar{
+	{name: "ECOWITT_LISTEN", field: "listenAddress", apply: func(c *Config, v string) error {
+		c.ListenAddress = v
+		return nil
+	}},
+	{name: "ECOWITT_METRICS_LISTEN", field: "metricsListenAddress", apply: func(c *Config, v string) error {
+		c.MetricsListenAddress = v
+		return nil
+	}},
+	{name: "ECOWITT_REPORT_PATH", field: "reportPath", apply: func(c *Config, v string) error {
+		c.ReportPath = v
+		return nil
+	}},
+	{name: "ECOWITT_NAMESPACE", field: "namespace", apply: func(c *Config, v string) error {
+		c.Namespace = v
+		return nil
+	}},
+	{name: "ECOWITT_ALLOWED_PASSKEYS", field: "allowedPasskeys (comma separated)", apply: func(c *Config, v string) error {
+		c.AllowedPasskeys = splitList(v)
+		return nil
+	}},
+	{name: "ECOWITT_STALE_AFTER", field: "staleAfter", apply: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.StaleAfter = Duration(d)
+		return err
+	}},
+	{name: "ECOWITT_MAX_REPORTS_PER_MINUTE", field: "maxReportsPerMinute", apply: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.MaxReportsPerMinute = n
+		return err
+	}},
+	{name: "ECOWITT_TLS_CERT_FILE", field: "tlsCertFile", apply: func(c *Config, v string) error {
+		c.TLSCertFile = v
+		return nil
+	}},
+	{name: "ECOWITT_TLS_KEY_FILE", field: "tlsKeyFile", apply: func(c *Config, v string) error {
+		c.TLSKeyFile = v
+		return nil
+	}},
+	{name: "ECOWITT_TLS_CLIENT_CA_FILE", field: "clientCaFile", apply: func(c *Config, v string) error {
+		c.ClientCAFile = v
+		return nil
+	}},
+	{name: "ECOWITT_INFLUX_TOKEN", field: "influxToken", apply: func(c *Config, v string) error {
+		c.InfluxToken = v
+		return nil
+	}},
+}
+
+// configFlags are the config fields that are set by command line flags, which take precedence over the environment
+// and the config file. Empty values are treated as unset.
+type configFlags struct {
+	listenAddress string
+}
+
+// apply overrides the config fields that have their flag set.
+func (f configFlags) apply(c *Config) {
+	if f.listenAddress != "" {
+		c.ListenAddress = f.listenAddress
+	}
+}
+
+// applyEnvironment overrides the config fields that have their environment variable set according to lookup, which is
+// normally os.LookupEnv. Empty variables are treated as unset.
+func (c *Config) applyEnvironment(lookup func(string) (string, bool)) error {
+	for _, e := range configEnvVars {
+		value, ok := lookup(e.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := e.apply(c, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", e.name, err)
+		}
+	}
+	return nil
+}
+
+// envUsage describes the environment variables for the usage text.
+func envUsage() string {
+	var sb strings.Builder
+	sb.WriteString("Environment:\n")
+	for _, e := range configEnvVars {
+		_, _ = fmt.Fprintf(&sb, "  %-31s overrides %s\n", e.name, e.field)
+	}
+	return sb.String()
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
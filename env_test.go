@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lookupMap returns a lookup function like os.LookupEnv for the variables in the map.
+func lookupMap(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := `{"listenAddress": ":1000", "staleAfter": "5m", "allowedPasskeys": ["FILE"], "maxReportsPerMinute": 10}`
+	for _, tc := range []struct {
+		name     string
+		env      map[string]string
+		flags    configFlags
+		expected Config
+	}{
+		{
+			name:     "file",
+			expected: Config{ListenAddress: ":1000", StaleAfter: Duration(5 * time.Minute), AllowedPasskeys: []string{"FILE"}, MaxReportsPerMinute: 10},
+		},
+		{
+			name: "environment over file",
+			env: map[string]string{
+				"ECOWITT_LISTEN":                 ":2000",
+				"ECOWITT_STALE_AFTER":            "10m",
+				"ECOWITT_ALLOWED_PASSKEYS":       "ENV1, ENV2",
+				"ECOWITT_MAX_REPORTS_PER_MINUTE": "20",
+			},
+			expected: Config{ListenAddress: ":2000", StaleAfter: Duration(10 * time.Minute), AllowedPasskeys: []string{"ENV1", "ENV2"}, MaxReportsPerMinute: 20},
+		},
+		{
+			name:     "empty environment is unset",
+			env:      map[string]string{"ECOWITT_LISTEN": "", "ECOWITT_ALLOWED_PASSKEYS": ""},
+			expected: Config{ListenAddress: ":1000", StaleAfter: Duration(5 * time.Minute), AllowedPasskeys: []string{"FILE"}, MaxReportsPerMinute: 10},
+		},
+		{
+			name:     "flag over environment",
+			env:      map[string]string{"ECOWITT_LISTEN": ":2000"},
+			flags:    configFlags{listenAddress: ":3000"},
+			expected: Config{ListenAddress: ":3000", StaleAfter: Duration(5 * time.Minute), AllowedPasskeys: []string{"FILE"}, MaxReportsPerMinute: 10},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			conf, err := loadConfig(path, lookupMap(tc.env))
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+			tc.flags.apply(conf)
+			actual := Config{
+				ListenAddress:       conf.ListenAddress,
+				StaleAfter:          conf.StaleAfter,
+				AllowedPasskeys:     conf.AllowedPasskeys,
+				MaxReportsPerMinute: conf.MaxReportsPerMinute,
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestApplyEnvironmentInvalidValues(t *testing.T) {
+	for _, name := range []string{"ECOWITT_STALE_AFTER", "ECOWITT_MAX_REPORTS_PER_MINUTE"} {
+		err := (&Config{}).applyEnvironment(lookupMap(map[string]string{name: "soon"}))
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("expected an error naming %s, got %v", name, err)
+		}
+	}
+}
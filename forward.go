@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	// forwardQueueSize is the number of reports buffered for each forwarder before the oldest are dropped.
+	forwardQueueSize = 100
+)
+
+// forwardRetry controls how a queuedForwarder retries failed sends and when its circuit breaker opens.
+type forwardRetry struct {
+	// minBackoff and maxBackoff bound the exponential backoff between attempts to send a report.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// maxAttempts is how many times a report is sent before it is dropped.
+	maxAttempts int
+	// breakerThreshold is how many reports in a row may be dropped after failing every attempt before the circuit
+	// breaker opens.
+	breakerThreshold int
+	// breakerCooldown is how long the circuit breaker stays open before a single report is tried again.
+	breakerCooldown time.Duration
+}
+
+// defaultForwardRetry tries each report for about 15 seconds, and stops trying for a minute at a time once three
+// reports in a row could not be sent.
+var defaultForwardRetry = forwardRetry{
+	minBackoff:       time.Second,
+	maxBackoff:       time.Minute,
+	maxAttempts:      5,
+	breakerThreshold: 3,
+	breakerCooldown:  time.Minute,
+}
+
+// report is a single parsed report from a station.
+type report struct {
+	// station has its source ip hashed or cleared according to the source ip mode.
+	station stationLabels
+	time    time.Time
+	fields  map[string]float64
+}
+
+// forwarder sends parsed reports to an external system. Implementations may block while sending since they are only
+// called from the background routine of a queuedForwarder.
+type forwarder interface {
+	// send returns a permanentError when retrying cannot succeed.
+	send(r report) error
+	close()
+}
+
+// permanentError marks a failure to send a report that retrying cannot fix, such as the downstream rejecting the report
+// as invalid.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// queuedForwarder feeds reports to a forwarder through a bounded queue drained by a single routine so that the report
+// handler never waits on the external system. Failed sends are retried with exponential backoff up to a number of
+// attempts, and reports that the downstream rejects are dropped without retrying. When the queue is full the oldest
+// reports are dropped to make room for new ones. Once several reports in a row have failed the circuit breaker opens
+// and reports are dropped without being sent until a single report succeeds after the cooldown, so that the queue
+// keeps draining while the downstream is unavailable.
+type queuedForwarder struct {
+	name      string
+	forwarder forwarder
+	retry     forwardRetry
+	// lock serialises producers so that dropping the oldest report and queueing the new one happen together.
+	lock        sync.Mutex
+	queue       chan report
+	stop        chan struct{}
+	done        chan struct{}
+	depth       prometheus.Gauge
+	dropped     prometheus.Counter
+	rejected    prometheus.Counter
+	circuitOpen prometheus.Gauge
+}
+
+func newQueuedForwarder(name string, f forwarder, metrics *relayMetrics) *queuedForwarder {
+	return startQueuedForwarder(name, f, metrics, defaultForwardRetry)
+}
+
+// startQueuedForwarder creates the queued forwarder and starts its background routine with the retry policy.
+func startQueuedForwarder(name string, f forwarder, metrics *relayMetrics, retry forwardRetry) *queuedForwarder {
+	q := &queuedForwarder{
+		name:        name,
+		forwarder:   f,
+		retry:       retry,
+		queue:       make(chan report, forwardQueueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		depth:       metrics.forwardQueueDepth.WithLabelValues(name),
+		dropped:     metrics.forwardDropped.WithLabelValues(name),
+		rejected:    metrics.forwardRejected.WithLabelValues(name),
+		circuitOpen: metrics.forwardCircuitOpen.WithLabelValues(name),
+	}
+	go q.run()
+	return q
+}
+
+// forward queues the report without blocking, dropping the oldest queued report if the queue is full.
+func (q *queuedForwarder) forward(r report) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		select {
+		case q.queue <- r:
+			q.depth.Set(float64(len(q.queue)))
+			return
+		default:
+		}
+		select {
+		case <-q.queue:
+			zap.S().Warnw("forward queue is full, dropping the oldest report", "forwarder", q.name)
+			q.dropped.Inc()
+		default:
+		}
+	}
+}
+
+// close stops the background routine, discarding any reports still queued, and then closes the forwarder.
+func (q *queuedForwarder) close() {
+	close(q.stop)
+	<-q.done
+	if n := len(q.queue); n > 0 {
+		zap.S().Warnw("discarding queued reports on shutdown", "forwarder", q.name, "reports", n)
+		q.dropped.Add(float64(n))
+	}
+	q.forwarder.close()
+}
+
+func (q *queuedForwarder) run() {
+	defer close(q.done)
+	var breaker circuitBreaker
+	for {
+		var r report
+		select {
+		case <-q.stop:
+			return
+		case r = <-q.queue:
+			q.depth.Set(float64(len(q.queue)))
+		}
+		attempts, ok := breaker.attempts(q.retry, time.Now())
+		if !ok {
+			q.dropped.Inc()
+			continue
+		}
+		stopped, err := q.send(r, attempts)
+		if stopped {
+			q.dropped.Inc()
+			return
+		}
+		var permanent *permanentError
+		switch {
+		case err == nil:
+			if breaker.succeeded() {
+				zap.S().Infow("forwarder recovered, closing circuit breaker", "forwarder", q.name)
+			}
+		case errors.As(err, &permanent):
+			zap.S().Errorw("forward report rejected, dropping it", "forwarder", q.name, "err", err)
+			q.rejected.Inc()
+		default:
+			zap.S().Warnw("failed to forward report, dropping it", "forwarder", q.name, "attempts", attempts, "err", err)
+			q.dropped.Inc()
+			if breaker.failed(q.retry, time.Now()) {
+				zap.S().Warnw("forwarder keeps failing, opening circuit breaker", "forwarder", q.name, "cooldown", q.retry.breakerCooldown)
+			}
+		}
+		q.circuitOpen.Set(breaker.openValue())
+	}
+}
+
+// send tries to send the report up to the number of attempts with exponential backoff between them, stopping early on
+// a permanent error. It returns true when the forwarder was closed while waiting to retry.
+func (q *queuedForwarder) send(r report, attempts int) (bool, error) {
+	var backoff time.Duration
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			backoff = q.retry.nextBackoff(backoff)
+			zap.S().Warnw("failed to forward report, retrying", "forwarder", q.name, "backoff", backoff, "err", err)
+			select {
+			case <-q.stop:
+				return true, err
+			case <-time.After(backoff):
+			}
+		}
+		err = q.forwarder.send(r)
+		var permanent *permanentError
+		if err == nil || errors.As(err, &permanent) {
+			return false, err
+		}
+	}
+	return false, err
+}
+
+// nextBackoff doubles the previous backoff within the bounds of minBackoff and maxBackoff.
+func (p forwardRetry) nextBackoff(previous time.Duration) time.Duration {
+	next := previous * 2
+	if next < p.minBackoff {
+		next = p.minBackoff
+	}
+	if next > p.maxBackoff {
+		next = p.maxBackoff
+	}
+	return next
+}
+
+// circuitBreaker tracks the reports that a forwarder failed to send. It is closed while sends succeed, opens once
+// breakerThreshold reports in a row fail, and after the cooldown is half-open to let a single report be tried once,
+// closing again if it succeeds and reopening if it does not. The zero value is closed.
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// attempts returns how many times the next report may be tried, the final return value is false when the breaker is
+// open and the report should be dropped without trying.
+func (b *circuitBreaker) attempts(p forwardRetry, now time.Time) (int, bool) {
+	if b.failures < p.breakerThreshold {
+		return p.maxAttempts, true
+	}
+	if now.Before(b.openUntil) {
+		return 0, false
+	}
+	return 1, true
+}
+
+// succeeded closes the breaker, returning true if it was not already closed.
+func (b *circuitBreaker) succeeded() bool {
+	wasOpen := !b.openUntil.IsZero()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	return wasOpen
+}
+
+// failed records a report that could not be sent and opens the breaker once enough have failed in a row, returning
+// true when it was closed before.
+func (b *circuitBreaker) failed(p forwardRetry, now time.Time) bool {
+	wasOpen := !b.openUntil.IsZero()
+	b.failures++
+	if b.failures >= p.breakerThreshold {
+		b.openUntil = now.Add(p.breakerCooldown)
+		return !wasOpen
+	}
+	return false
+}
+
+// openValue is 1 while the breaker is open or half-open and 0 while it is closed, for the forward_circuit_open gauge.
+func (b *circuitBreaker) openValue() float64 {
+	if b.openUntil.IsZero() {
+		return 0
+	}
+	return 1
+}
+
+// forwardedValue is the value of a field that was last forwarded and when.
+type forwardedValue struct {
+	value float64
+	at    time.Time
+}
+
+// forwardedFields remembers the value of each field of each station that was last forwarded so that unchanged fields
+// can be skipped. The memory used is bounded by the number of stations and fields. The zero value is ready to use.
+type forwardedFields struct {
+	lock sync.Mutex
+	last map[string]forwardedValue
+}
+
+// changed returns the fields of the station that differ from the values last forwarded, or that were last forwarded
+// at least maxInterval before now, and records them as forwarded.
+func (f *forwardedFields) changed(station stationLabels, fields map[string]float64, now time.Time, maxInterval time.Duration) map[string]float64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.last == nil {
+		f.last = make(map[string]forwardedValue)
+	}
+	labels := station.labels()
+	out := make(map[string]float64, len(fields))
+	for field, value := range fields {
+		key := seriesKey(field, labels)
+		if last, ok := f.last[key]; ok && last.value == value && now.Sub(last.at) < maxInterval {
+			continue
+		}
+		f.last[key] = forwardedValue{value: value, at: now}
+		out[field] = value
+	}
+	return out
+}
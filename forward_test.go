@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testForwardRetry retries quickly so that the tests do not wait on the real backoff.
+var testForwardRetry = forwardRetry{
+	minBackoff:       time.Millisecond,
+	maxBackoff:       2 * time.Millisecond,
+	maxAttempts:      3,
+	breakerThreshold: 2,
+	breakerCooldown:  200 * time.Millisecond,
+}
+
+// scriptedForwarder fails each send with the error returned by result for the report and the attempt number of it.
+type scriptedForwarder struct {
+	lock   sync.Mutex
+	result func(r report, attempt int) error
+	calls  map[float64]int
+	sent   []float64
+}
+
+func newScriptedForwarder(result func(r report, attempt int) error) *scriptedForwarder {
+	return &scriptedForwarder{result: result, calls: make(map[float64]int)}
+}
+
+func (f *scriptedForwarder) send(r report) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	id := r.fields["id"]
+	f.calls[id]++
+	if err := f.result(r, f.calls[id]); err != nil {
+		return err
+	}
+	f.sent = append(f.sent, id)
+	return nil
+}
+
+func (f *scriptedForwarder) close() {}
+
+func (f *scriptedForwarder) callsFor(id float64) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[id]
+}
+
+func (f *scriptedForwarder) sentIds() []float64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]float64(nil), f.sent...)
+}
+
+func testReport(id float64) report {
+	return report{fields: map[string]float64{"id": id}}
+}
+
+// waitFor fails the test if the condition does not become true within a second.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func startTestForwarder(t *testing.T, f forwarder) (*queuedForwarder, *relayMetrics) {
+	t.Helper()
+	metrics := newRelayMetrics(prometheus.NewRegistry(), testConfig(t, `{}`))
+	q := startQueuedForwarder("test", f, metrics, testForwardRetry)
+	t.Cleanup(q.close)
+	return q, metrics
+}
+
+func TestForwarderDropsRejectedReports(t *testing.T) {
+	f := newScriptedForwarder(func(r report, attempt int) error {
+		if r.fields["id"] == 1 {
+			return &permanentError{errors.New("bad line")}
+		}
+		return nil
+	})
+	q, metrics := startTestForwarder(t, f)
+	q.forward(testReport(1))
+	q.forward(testReport(2))
+
+	waitFor(t, "the second report to be sent", func() bool { return len(f.sentIds()) == 1 })
+	if calls := f.callsFor(1); calls != 1 {
+		t.Errorf("expected the rejected report to be tried once, got %d", calls)
+	}
+	if rejected := testutil.ToFloat64(metrics.forwardRejected.WithLabelValues("test")); rejected != 1 {
+		t.Errorf("expected 1 rejected report, got %v", rejected)
+	}
+}
+
+func TestForwarderCapsAttempts(t *testing.T) {
+	f := newScriptedForwarder(func(r report, attempt int) error {
+		if r.fields["id"] == 1 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	q, metrics := startTestForwarder(t, f)
+	q.forward(testReport(1))
+	q.forward(testReport(2))
+
+	waitFor(t, "the second report to be sent", func() bool { return len(f.sentIds()) == 1 })
+	if calls := f.callsFor(1); calls != testForwardRetry.maxAttempts {
+		t.Errorf("expected the failing report to be tried %d times, got %d", testForwardRetry.maxAttempts, calls)
+	}
+	if dropped := testutil.ToFloat64(metrics.forwardDropped.WithLabelValues("test")); dropped != 1 {
+		t.Errorf("expected 1 dropped report, got %v", dropped)
+	}
+}
+
+func TestForwarderCircuitBreaker(t *testing.T) {
+	var lock sync.Mutex
+	healthy := false
+	f := newScriptedForwarder(func(r report, attempt int) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if !healthy {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	q, metrics := startTestForwarder(t, f)
+	dropped := func() float64 { return testutil.ToFloat64(metrics.forwardDropped.WithLabelValues("test")) }
+	circuitOpen := func() float64 { return testutil.ToFloat64(metrics.forwardCircuitOpen.WithLabelValues("test")) }
+
+	// the breaker opens once two reports in a row fail every attempt
+	q.forward(testReport(1))
+	q.forward(testReport(2))
+	waitFor(t, "the breaker to open", func() bool { return circuitOpen() == 1 })
+
+	// while open the reports are dropped without being sent, so the queue keeps draining
+	for id := 3.0; id < 10; id++ {
+		q.forward(testReport(id))
+	}
+	waitFor(t, "the reports to be dropped", func() bool { return dropped() == 9 })
+	if calls := f.callsFor(3); calls != 0 {
+		t.Errorf("expected no attempt to send while the breaker is open, got %d", calls)
+	}
+
+	// after the cooldown a single attempt is made, which fails and reopens the breaker
+	time.Sleep(testForwardRetry.breakerCooldown)
+	q.forward(testReport(10))
+	waitFor(t, "the half-open attempt", func() bool { return dropped() == 10 })
+	if calls := f.callsFor(10); calls != 1 {
+		t.Errorf("expected a single half-open attempt, got %d", calls)
+	}
+	if open := circuitOpen(); open != 1 {
+		t.Errorf("expected the breaker to reopen, got %v", open)
+	}
+
+	// once the downstream recovers the next half-open attempt closes the breaker
+	lock.Lock()
+	healthy = true
+	lock.Unlock()
+	time.Sleep(testForwardRetry.breakerCooldown)
+	q.forward(testReport(11))
+	q.forward(testReport(12))
+	waitFor(t, "the reports to be sent", func() bool { return len(f.sentIds()) == 2 })
+	if open := circuitOpen(); open != 0 {
+		t.Errorf("expected the breaker to close, got %v", open)
+	}
+}
+
+func TestInfluxClientErrorsArePermanent(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+		f := newInfluxForwarder(&Config{InfluxURL: server.URL, InfluxBucket: "weather"})
+		err := f.send(report{station: stationLabels{Model: "GW1100B"}, fields: map[string]float64{"tempf": 70}})
+		server.Close()
+		var permanent *permanentError
+		if err == nil || errors.As(err, &permanent) != tc.permanent {
+			t.Errorf("status %d: expected an error that is permanent %v, got %v", tc.status, tc.permanent, err)
+		}
+	}
+}
+
+// forwardingHandler returns a report handler for the config that forwards every report to the forwarder, with its
+// metrics registered with the returned registry.
+func forwardingHandler(t *testing.T, conf *Config, f forwarder) (http.Handler, *prometheus.Registry) {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	metrics := newRelayMetrics(registry, conf)
+	q := startQueuedForwarder("test", f, metrics, testForwardRetry)
+	t.Cleanup(q.close)
+	r, err := newRelay(conf, metrics, []*queuedForwarder{q})
+	if err != nil {
+		t.Fatalf("failed to create relay: %v", err)
+	}
+	return http.HandlerFunc(r.handleReport), registry
+}
+
+func TestInfluxHashesSourceIp(t *testing.T) {
+	lines := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lines <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	for _, tc := range []struct {
+		mode     string
+		expected string
+	}{
+		{sourceIpHashed, "source_ip=" + hashSourceIp("192.0.2.1") + ","},
+		{sourceIpOmit, "model=unknown,stationType=unknown,"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			conf := testConfig(t, `{"sourceIpMode": "`+tc.mode+`", "influxUrl": "`+server.URL+`", "influxBucket": "weather"}`)
+			handler, _ := forwardingHandler(t, conf, newInfluxForwarder(conf))
+			postForm(t, handler, "tempf=70")
+			select {
+			case line := <-lines:
+				if strings.Contains(line, "192.0.2.1") || !strings.Contains(line, tc.expected) {
+					t.Errorf("expected the line to contain %q and not the source ip, got %q", tc.expected, line)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for the influx write")
+			}
+		})
+	}
+}
+
+// fakeMqttClient records the messages published to it, the methods it does not implement panic.
+type fakeMqttClient struct {
+	mqtt.Client
+	messages chan fakeMqttMessage
+}
+
+type fakeMqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (c *fakeMqttClient) IsConnectionOpen() bool {
+	return true
+}
+
+func (c *fakeMqttClient) Disconnect(uint) {}
+
+func (c *fakeMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.messages <- fakeMqttMessage{topic: topic, payload: payload.([]byte)}
+	return &mqtt.DummyToken{}
+}
+
+func TestMqttHashesSourceIp(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		expected string
+	}{
+		{sourceIpHashed, hashSourceIp("192.0.2.1")},
+		{sourceIpOmit, ""},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			client := &fakeMqttClient{messages: make(chan fakeMqttMessage, 1)}
+			conf := testConfig(t, `{"sourceIpMode": "`+tc.mode+`"}`)
+			handler, _ := forwardingHandler(t, conf, &mqttForwarder{client: client, prefix: defaultMqttTopicPrefix})
+			postForm(t, handler, "tempf=70")
+			select {
+			case published := <-client.messages:
+				var message mqttMessage
+				if err := json.Unmarshal(published.payload, &message); err != nil {
+					t.Fatalf("failed to decode message: %v", err)
+				}
+				if message.SourceIP != tc.expected {
+					t.Errorf("expected source_ip %q, got %q", tc.expected, message.SourceIP)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for the mqtt message")
+			}
+		})
+	}
+}
+
+func TestMqttTopics(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		station  stationLabels
+		field    string
+		expected string
+	}{
+		{"named", stationLabels{StationName: "garden", Model: "GW1100B", SourceIP: "192.0.2.1"}, "tempf", "ecowitt/garden/tempf"},
+		{"wildcards", stationLabels{StationName: "roof/#1+", Model: "GW1100B"}, "temp+f", "ecowitt/roof__1_/temp_f"},
+		{"unknown", stationLabels{StationName: "unknown", Model: "GW1100B", SourceIP: "192.0.2.1"}, "tempf", "ecowitt/unknown-GW1100B-192.0.2.1/tempf"},
+		{"unknown without source ip", stationLabels{StationName: "unknown", Model: "GW1100B"}, "tempf", "ecowitt/unknown-GW1100B/tempf"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeMqttClient{messages: make(chan fakeMqttMessage, 1)}
+			f := &mqttForwarder{client: client, prefix: defaultMqttTopicPrefix}
+			if err := f.send(report{station: tc.station, fields: map[string]float64{tc.field: 70}}); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+			if published := <-client.messages; published.topic != tc.expected {
+				t.Errorf("expected topic %s, got %s", tc.expected, published.topic)
+			}
+		})
+	}
+}
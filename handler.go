@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// relay holds the state shared by the handlers that accept reports. It only depends on the config and registerer it
+// is constructed with, so that the handlers can be driven with httptest and a fresh registry.
+type relay struct {
+	// config holds the live config, which is swapped when it is reloaded.
+	config    *atomic.Pointer[Config]
+	metrics   *relayMetrics
+	processor *reportProcessor
+	sourceIps *sourceIpResolver
+	// allowed holds the networks that reports are accepted from, or nil to accept reports from everywhere.
+	allowed []*net.IPNet
+	limiter *rateLimiter
+	// upstream replays the reports to the upstreamForwardUrl when it is set, otherwise it is nil.
+	upstream *upstreamForwarder
+	// latest holds the latest report from each station when the debug endpoint is enabled, otherwise it is nil.
+	latest *lastReports
+	// reports counts the reports that have been processed.
+	reports int64
+}
+
+// newRelay creates the shared state of the report handlers from a validated config, with the report gauges
+// registered with the metrics and every report passed on to the forwarders.
+func newRelay(conf *Config, metrics *relayMetrics, forwarders []*queuedForwarder) (*relay, error) {
+	sourceIps, err := newSourceIpResolver(conf.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := parseNetworks("allowedCidrs entry", conf.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	r := &relay{
+		config:    &atomic.Pointer[Config]{},
+		metrics:   metrics,
+		processor: &reportProcessor{metrics: metrics, forwarders: forwarders},
+		sourceIps: sourceIps,
+		allowed:   allowed,
+		limiter:   newRateLimiter(conf.MaxReportsPerMinute),
+	}
+	r.config.Store(conf)
+	return r, nil
+}
+
+// newReportHandler returns a handler for the report path that registers its metrics with the registerer and does not
+// forward the reports anywhere. The config must have passed Validate.
+func newReportHandler(cfg *Config, reg prometheus.Registerer) (http.HandlerFunc, error) {
+	r, err := newRelay(cfg, newRelayMetrics(reg, cfg), nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.handleReport, nil
+}
+
+// sourceAllowed returns whether reports are accepted from the verified source ip. Rejected reports are only logged,
+// since counting them by source ip would let anyone create an unbounded number of series.
+func (r *relay) sourceAllowed(clientIp string) bool {
+	if r.allowed == nil || networksContain(r.allowed, clientIp) {
+		return true
+	}
+	zap.S().Warnw("rejected report from a source ip outside the allowed cidrs", "source_ip", clientIp)
+	return false
+}
+
+// reportCount returns the number of reports that have been processed.
+func (r *relay) reportCount() int64 {
+	return atomic.LoadInt64(&r.reports)
+}
+
+// handleReport accepts a report posted by a station in the ecowitt protocol.
+func (r *relay) handleReport(writer http.ResponseWriter, request *http.Request) {
+	received := time.Now()
+	conf := r.config.Load()
+	if request.Method != http.MethodPost {
+		zap.S().Debugw("rejected report with unsupported method", "method", request.Method, "uri", request.RequestURI)
+		zap.S().Debugf("received headers: %v", request.Header.Clone())
+		r.metrics.incrementRejectedMethod(request.Method)
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sourceIp, clientIp := r.sourceIps.resolve(request), r.sourceIps.resolveVerified(request)
+	if !r.sourceAllowed(clientIp) {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !r.limiter.allow(clientIp, time.Now()) {
+		zap.S().Warnw("rate limited report", "source_ip", sourceIp, "client_ip", clientIp)
+		// the verified address is counted so that a spoofed header cannot create a new series for each request
+		r.metrics.incrementRateLimited(clientIp)
+		writer.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	request.Body = http.MaxBytesReader(writer, request.Body, conf.MaxBodyBytes)
+	data, err := readReportBody(request)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			zap.S().Warnw("rejected report with oversized body", "source_ip", sourceIp, "client_ip", clientIp, "limit", tooLarge.Limit)
+			r.metrics.incrementOversized(clientIp)
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		var invalid *invalidBodyError
+		if errors.As(err, &invalid) {
+			zap.S().Warnw("rejected report with invalid body", "source_ip", sourceIp, "err", err)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		zap.S().Errorw("failed to read body stream", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	zap.S().Debugf("received request: %v", request.RequestURI)
+	zap.S().Debugf("received headers: %v", request.Header.Clone())
+	zap.S().Debugf("received report: '%v'", string(data))
+	r.metrics.addBytesReceived(len(data))
+
+	values, err := parseReport(request.Header.Get("Content-Type"), data)
+	if err != nil {
+		zap.S().Warnf("failed to parse report: %v", err)
+		if conf.StrictParse {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeReportAccepted(writer, conf)
+		return
+	}
+	if !conf.passkeyAllowed(values.Get("PASSKEY")) {
+		zap.S().Warnw("rejected report with unknown passkey", "source_ip", sourceIp)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// a useless report is rejected before it is recorded, counted, or relayed
+	if conf.StrictParse && countUsableFields(conf, values) == 0 {
+		zap.S().Warnw("rejected report without any usable fields", "source_ip", sourceIp)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.latest != nil {
+		r.latest.record(sourceIp, data, values)
+	}
+	if r.upstream != nil {
+		r.upstream.forward(request.Header, data)
+	}
+
+	writeReportAccepted(writer, conf)
+	r.processor.process(conf, sourceIp, values, len(data), received)
+	atomic.AddInt64(&r.reports, 1)
+}
+
+// handleWunderground accepts a report sent by a station in the Weather Underground protocol.
+func (r *relay) handleWunderground(writer http.ResponseWriter, request *http.Request) {
+	received := time.Now()
+	conf := r.config.Load()
+	if request.Method != http.MethodGet {
+		zap.S().Debugw("rejected wunderground report with unsupported method", "method", request.Method, "uri", request.RequestURI)
+		r.metrics.incrementRejectedMethod(request.Method)
+		writer.Header().Set("Allow", http.MethodGet)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sourceIp, clientIp := r.sourceIps.resolve(request), r.sourceIps.resolveVerified(request)
+	if !r.sourceAllowed(clientIp) {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !r.limiter.allow(clientIp, time.Now()) {
+		zap.S().Warnw("rate limited report", "source_ip", sourceIp, "client_ip", clientIp)
+		// the verified address is counted so that a spoofed header cannot create a new series for each request
+		r.metrics.incrementRateLimited(clientIp)
+		writer.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	r.metrics.addBytesReceived(len(request.URL.RawQuery))
+	values := fromWunderground(request.URL.Query())
+	if !conf.passkeyAllowed(values.Get("PASSKEY")) {
+		zap.S().Warnw("rejected wunderground report with unknown station id", "source_ip", sourceIp)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// stations using this protocol expect the same response as the Weather Underground api
+	_, _ = writer.Write([]byte("success\n"))
+	r.processor.process(conf, sourceIp, values, len(request.URL.RawQuery), received)
+	atomic.AddInt64(&r.reports, 1)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// volatileMetrics are the gauges and counters whose values depend on the size of the body or the time that the report
+// was handled, and so differ between otherwise identical reports.
+var volatileMetrics = map[string]bool{
+	"ecowitt_relay_bytes_received_total":          true,
+	"ecowitt_relay_last_report_timestamp_seconds": true,
+	"ecowitt_relay_start_time_seconds":            true,
+}
+
+// testConfig decodes the json config, applies the defaults, and fails the test if it does not validate.
+func testConfig(t *testing.T, raw string) *Config {
+	t.Helper()
+	conf := &Config{}
+	if err := json.Unmarshal([]byte(raw), conf); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	conf.applyDefaults()
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	return conf
+}
+
+// testReportHandler returns a report handler for the config with its metrics registered with a fresh registry.
+func testReportHandler(t *testing.T, conf *Config) (http.HandlerFunc, *prometheus.Registry) {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	handler, err := newReportHandler(conf, registry)
+	if err != nil {
+		t.Fatalf("failed to create report handler: %v", err)
+	}
+	return handler, registry
+}
+
+// postReport posts the body to the handler and returns the response.
+func postReport(handler http.Handler, contentType, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, defaultReportPath, strings.NewReader(body))
+	request.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// gatherValues returns the value of every gauge and counter series of the registry keyed by its name and labels,
+// leaving out the volatile metrics.
+func gatherValues(t *testing.T, registry prometheus.Gatherer) map[string]float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		if volatileMetrics[family.GetName()] {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			key := fmt.Sprintf("%s{%s}", family.GetName(), formatLabelPairs(metric.GetLabel()))
+			switch {
+			case metric.GetGauge() != nil:
+				values[key] = metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				values[key] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestFormAndJsonReportsProduceIdenticalMetrics(t *testing.T) {
+	conf := testConfig(t, `{}`)
+	form := "PASSKEY=ABC&stationtype=GW1100B_V2.3.5&dateutc=2024-01-02+15:04:05&tempf=70.2&humidity=55&windspeedmph=3.4&baromrelin=29.921&dailyrainin=0.12&model=GW1100B"
+	jsonBody := `{"PASSKEY":"ABC","stationtype":"GW1100B_V2.3.5","dateutc":"2024-01-02 15:04:05","tempf":70.2,"humidity":55,"windspeedmph":3.4,"baromrelin":29.921,"dailyrainin":0.12,"model":"GW1100B"}`
+
+	formHandler, formRegistry := testReportHandler(t, conf)
+	if code := postReport(formHandler, "application/x-www-form-urlencoded", form).Code; code != http.StatusOK {
+		t.Fatalf("expected form report to be accepted, got %d", code)
+	}
+	jsonHandler, jsonRegistry := testReportHandler(t, conf)
+	if code := postReport(jsonHandler, "application/json", jsonBody).Code; code != http.StatusOK {
+		t.Fatalf("expected json report to be accepted, got %d", code)
+	}
+
+	formValues, jsonValues := gatherValues(t, formRegistry), gatherValues(t, jsonRegistry)
+	if _, ok := formValues[`ecowitt_relay_temp_celsius{channel="outdoor",model="GW1100B",source_ip="192.0.2.1",stationType="GW1100B_V2.3.5",station_name="unknown"}`]; !ok {
+		t.Fatalf("expected the form report to produce the temperature gauge, got %v", formValues)
+	}
+	if !reflect.DeepEqual(formValues, jsonValues) {
+		for key, value := range formValues {
+			if other, ok := jsonValues[key]; !ok || other != value {
+				t.Errorf("form produced %s %v, json produced %v (present %v)", key, value, other, ok)
+			}
+		}
+		for key, value := range jsonValues {
+			if _, ok := formValues[key]; !ok {
+				t.Errorf("json produced %s %v that the form did not", key, value)
+			}
+		}
+	}
+}
+
+// postRawChunked posts the raw chunked body to the server over a new connection, closing the write side of the
+// connection after the body so that a truncated body ends the stream, and returns the status code of the response.
+func postRawChunked(t *testing.T, server *httptest.Server, body string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: relay\r\nContent-Type: application/x-www-form-urlencoded\r\nTransfer-Encoding: chunked\r\n\r\n%s", defaultReportPath, body)
+	if err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestChunkedReportBody(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{"maxBodyBytes": 32}`))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"valid", "6\r\ntempf=\r\n4\r\n70.2\r\n0\r\n\r\n", http.StatusOK},
+		{"truncated", "6\r\ntempf=\r\n10\r\n70.2", http.StatusBadRequest},
+		{"invalid chunk length", "6\r\ntempf=\r\nzz\r\n70.2\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"over the limit", "14\r\ntempf=70.2&humidity=\r\n14\r\n55&windspeedmph=3.4&\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := postRawChunked(t, server, tc.body); code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, code)
+			}
+		})
+	}
+	values := gatherValues(t, registry)
+	if actual := values[`ecowitt_relay_tempf_raw{model="unknown",source_ip="127.0.0.1",stationType="unknown",station_name="unknown"}`]; actual != 70.2 {
+		t.Errorf("expected the valid chunked body to set tempf_raw to 70.2, got %v", actual)
+	}
+}
+
+// postFrom posts the report from the peer address with the X-Real-IP header when realIp is set, and returns the status
+// code of the response.
+func postFrom(handler http.Handler, peer, realIp, body string) int {
+	request := httptest.NewRequest(http.MethodPost, defaultReportPath, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = peer + ":40000"
+	if realIp != "" {
+		request.Header.Set("X-Real-IP", realIp)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestAllowedCidrsCannotBeSpoofed(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   string
+		peer     string
+		realIp   string
+		expected int
+	}{
+		{"allowed peer", `{"allowedCidrs": ["10.0.0.0/8"]}`, "10.1.1.1", "", http.StatusOK},
+		{"denied peer", `{"allowedCidrs": ["10.0.0.0/8"]}`, "203.0.113.5", "", http.StatusForbidden},
+		{"spoofed header without trusted proxies", `{"allowedCidrs": ["10.0.0.0/8"]}`, "203.0.113.5", "10.1.1.1", http.StatusForbidden},
+		{"header from a trusted proxy", `{"allowedCidrs": ["10.0.0.0/8"], "trustedProxies": ["192.0.2.1"]}`, "192.0.2.1", "10.1.1.1", http.StatusOK},
+		{"denied header from a trusted proxy", `{"allowedCidrs": ["10.0.0.0/8"], "trustedProxies": ["192.0.2.1"]}`, "192.0.2.1", "203.0.113.5", http.StatusForbidden},
+		{"spoofed header from an untrusted peer", `{"allowedCidrs": ["10.0.0.0/8"], "trustedProxies": ["192.0.2.1"]}`, "203.0.113.5", "10.1.1.1", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, _ := testReportHandler(t, testConfig(t, tc.config))
+			if code := postFrom(handler, tc.peer, tc.realIp, "tempf=70"); code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, code)
+			}
+		})
+	}
+}
+
+func TestRateLimitCannotBeSpoofed(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{"maxReportsPerMinute": 2}`))
+	for i, realIp := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+		expected := http.StatusOK
+		if i >= 2 {
+			expected = http.StatusTooManyRequests
+		}
+		if code := postFrom(handler, "203.0.113.5", realIp, "tempf=70"); code != expected {
+			t.Errorf("report %d: expected %d, got %d", i, expected, code)
+		}
+	}
+	// the rejections are counted against the peer rather than the spoofed headers
+	values := gatherValues(t, registry)
+	if actual := values[`ecowitt_relay_rate_limited_reports_total{source_ip="203.0.113.5"}`]; actual != 3 {
+		t.Errorf("expected 3 rate limited reports from the peer, got %v", actual)
+	}
+	for key := range values {
+		if strings.HasPrefix(key, "ecowitt_relay_rate_limited_reports_total{") && !strings.Contains(key, "203.0.113.5") {
+			t.Errorf("expected no rate limited series for a spoofed address, got %s", key)
+		}
+	}
+}
+
+func TestOversizedReportsCannotBeSpoofed(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{"maxBodyBytes": 8}`))
+	for _, realIp := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if code := postFrom(handler, "203.0.113.5", realIp, "tempf=70&humidity=55"); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected %d, got %d", http.StatusRequestEntityTooLarge, code)
+		}
+	}
+	values := gatherValues(t, registry)
+	if actual := values[`ecowitt_relay_oversized_reports_total{source_ip="203.0.113.5"}`]; actual != 3 {
+		t.Errorf("expected 3 oversized reports from the peer, got %v", actual)
+	}
+	for key := range values {
+		if strings.HasPrefix(key, "ecowitt_relay_oversized_reports_total{") && !strings.Contains(key, "203.0.113.5") {
+			t.Errorf("expected no oversized series for a spoofed address, got %s", key)
+		}
+	}
+}
+
+func TestStrictParseRejectsBeforeSideEffects(t *testing.T) {
+	f := newScriptedForwarder(func(r report, attempt int) error { return nil })
+	handler, registry := forwardingHandler(t, testConfig(t, `{"strictParse": true}`), f)
+	for _, body := range []string{"PASSKEY=ABC&model=GW1100B", "tempf=hot", "tempf=NaN"} {
+		if code := postReport(handler, "application/x-www-form-urlencoded", body).Code; code != http.StatusBadRequest {
+			t.Errorf("expected '%s' to be rejected, got %d", body, code)
+		}
+	}
+	postForm(t, handler, "id=1&tempf=70")
+	waitFor(t, "the usable report to be forwarded", func() bool { return len(f.sentIds()) == 1 })
+
+	values := gatherValues(t, registry)
+	if actual := values["ecowitt_relay_report_count{"+testStationLabels+"}"]; actual != 1 {
+		t.Errorf("expected only the usable report to be counted, got %v", actual)
+	}
+	if sent := f.sentIds(); len(sent) != 1 || sent[0] != 1 {
+		t.Errorf("expected only the usable report to be forwarded, got %v", sent)
+	}
+}
+
+func TestRejectedMethodsAreCountedByName(t *testing.T) {
+	conf := testConfig(t, `{}`)
+	registry := prometheus.NewRegistry()
+	r, err := newRelay(conf, newRelayMetrics(registry, conf), nil)
+	if err != nil {
+		t.Fatalf("failed to create relay: %v", err)
+	}
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		method  string
+	}{
+		{r.handleWunderground, http.MethodPost},
+		{r.handleReport, http.MethodGet},
+		{r.handleReport, "BREW"},
+	} {
+		recorder := httptest.NewRecorder()
+		tc.handler(recorder, httptest.NewRequest(tc.method, "/", nil))
+		if recorder.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected %s to be rejected, got %d", tc.method, recorder.Code)
+		}
+	}
+	values := gatherValues(t, registry)
+	for _, method := range []string{http.MethodPost, http.MethodGet, "other"} {
+		if actual := values[`ecowitt_relay_rejected_method_total{method="`+method+`"}`]; actual != 1 {
+			t.Errorf("expected 1 rejected %s request, got %v", method, actual)
+		}
+	}
+}
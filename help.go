@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rawFieldHelp describes the quantity and unit of the report fields that stations commonly send, used as the help
+// text of their raw gauges.
+var rawFieldHelp = map[string]string{
+	"tempf":             "Outdoor temperature in degrees fahrenheit.",
+	"tempinf":           "Indoor temperature in degrees fahrenheit.",
+	"humidity":          "Outdoor relative humidity in percent.",
+	"humidityin":        "Indoor relative humidity in percent.",
+	"baromrelin":        "Relative barometric pressure in inches of mercury.",
+	"baromabsin":        "Absolute barometric pressure in inches of mercury.",
+	"winddir":           "Wind direction in degrees.",
+	"winddir_avg10m":    "Average wind direction over 10 minutes in degrees.",
+	"windspeedmph":      "Wind speed in miles per hour.",
+	"windgustmph":       "Wind gust speed in miles per hour.",
+	"maxdailygust":      "Maximum wind gust speed today in miles per hour.",
+	"windspdmph_avg10m": "Average wind speed over 10 minutes in miles per hour.",
+	"solarradiation":    "Solar radiation in the unit configured by solarRadiationUnit.",
+	"uv":                "UV index.",
+	"rainratein":        "Rain rate in inches per hour.",
+	"eventrainin":       "Rainfall of the current rain event in inches.",
+	"hourlyrainin":      "Rainfall over the last hour in inches.",
+	"dailyrainin":       "Rainfall today in inches.",
+	"weeklyrainin":      "Rainfall this week in inches.",
+	"monthlyrainin":     "Rainfall this month in inches.",
+	"yearlyrainin":      "Rainfall this year in inches.",
+	"totalrainin":       "Total rainfall since the station was reset in inches.",
+	"lightning":         "Distance to the latest lightning strike in the unit configured by lightningDistanceUnit.",
+	"lightning_num":     "Number of lightning strikes detected today.",
+	"lightning_time":    "Unix time in seconds of the latest lightning strike.",
+	"co2":               "CO2 concentration in parts per million.",
+	"runtime":           "Seconds since the station started.",
+	"heap":              "Free heap memory of the station in bytes.",
+	"interval":          "Reporting interval of the station in seconds.",
+}
+
+// rawFieldHelpPatterns describe the per channel fields, with the submatch being the channel.
+var rawFieldHelpPatterns = []struct {
+	pattern *regexp.Regexp
+	help    string
+}{
+	{regexp.MustCompile(`^temp([1-8])f$`), "Temperature of channel %s in degrees fahrenheit."},
+	{regexp.MustCompile(`^humidity([1-8])$`), "Relative humidity of channel %s in percent."},
+	{regexp.MustCompile(`^soilmoisture([1-8])$`), "Soil moisture of channel %s in percent."},
+	{regexp.MustCompile(`^pm25_ch([1-4])$`), "PM2.5 concentration of channel %s in micrograms per cubic metre."},
+	{regexp.MustCompile(`^pm25_avg_24h_ch([1-4])$`), "24 hour average PM2.5 concentration of channel %s in micrograms per cubic metre."},
+	{regexp.MustCompile(`^batt([1-8])$`), "Battery state of channel %s, 0 is ok and 1 is low."},
+}
+
+// gaugeHelp describes the converted and derived gauges.
+var gaugeHelp = map[string]string{
+	temperatureGauge:         "Temperature in degrees celsius, by sensor channel.",
+	humidityGauge:            "Relative humidity in percent, by sensor channel.",
+	batteryLowGauge:          "Whether the battery of the sensor is low.",
+	"station_info":           "Always 1, labelled with the firmware version of the station.",
+	"barom_rel_hpa":          "Relative barometric pressure in hectopascals.",
+	"barom_abs_hpa":          "Absolute barometric pressure in hectopascals.",
+	"windspeed_mps":          "Wind speed in metres per second.",
+	"windgust_mps":           "Wind gust speed in metres per second.",
+	"maxdailygust_mps":       "Maximum wind gust speed today in metres per second.",
+	"windspd_avg10m_mps":     "Average wind speed over 10 minutes in metres per second.",
+	"wind_compass":           "Index of the 16 point compass sector of the wind direction, labelled with its name.",
+	"wind_avg10m_compass":    "Index of the 16 point compass sector of the 10 minute average wind direction, labelled with its name.",
+	"uv_index":               "UV index.",
+	"solar_radiation_wm2":    "Solar radiation in watts per square metre.",
+	"rainrate_mm":            "Rain rate in millimetres per hour.",
+	"eventrain_mm":           "Rainfall of the current rain event in millimetres.",
+	"hourlyrain_mm":          "Rainfall over the last hour in millimetres.",
+	"dailyrain_mm":           "Rainfall today in millimetres.",
+	"weeklyrain_mm":          "Rainfall this week in millimetres.",
+	"monthlyrain_mm":         "Rainfall this month in millimetres.",
+	"yearlyrain_mm":          "Rainfall this year in millimetres.",
+	"totalrain_mm":           "Total rainfall since the station was reset in millimetres.",
+	lightningDistanceGauge:   "Distance to the latest lightning strike in kilometres.",
+	snowWaterEquivalentGauge: "Accumulated precipitation in millimetres while the station reports snow, otherwise 0.",
+	pressureTendencyGauge:    "Change in barometric pressure over the last three hours in hectopascals.",
+	"cloud_base_meters":      "Estimated height of the cloud base above the station in metres.",
+	"wet_bulb_celsius":       "Outdoor wet bulb temperature in degrees celsius.",
+	"heat_index_celsius":     "Outdoor heat index in degrees celsius.",
+	"wind_chill_celsius":     "Outdoor wind chill in degrees celsius.",
+	"feels_like_celsius":     "Outdoor apparent temperature in degrees celsius.",
+}
+
+// sensorGaugeHelp describes the derived gauges that exist for both the outdoor and indoor sensors, keyed by the name
+// with the sensor infix removed.
+var sensorGaugeHelp = map[string]string{
+	"saturation_vapor_pressure_kpa":  "Saturation vapor pressure in kilopascals.",
+	"actual_vapor_pressure_kpa":      "Actual vapor pressure in kilopascals.",
+	"vapor_pressure_deficit_kpa":     "Vapor pressure deficit in kilopascals.",
+	"dewpoint_celsius":               "Dew point in degrees celsius.",
+	"absolute_humidity_grams_per_m3": "Absolute humidity in grams per cubic metre.",
+}
+
+// fieldGaugeHelp returns the help text of a gauge created from station reports. The measurement is what the gauge
+// holds, which differs from the name when several measurements share a gauge, and raw gauges are described by the
+// report field they hold. Unknown gauges get a generic description.
+func fieldGaugeHelp(name, measurement string, raw bool, rawSuffix string) string {
+	if name != measurement {
+		return "Latest value of each measurement reported by the station, identified by the measurement label."
+	}
+	if raw {
+		field := strings.TrimSuffix(name, rawSuffix)
+		if help, ok := rawFieldHelp[field]; ok {
+			return help
+		}
+		for _, p := range rawFieldHelpPatterns {
+			if m := p.pattern.FindStringSubmatch(field); m != nil {
+				return fmt.Sprintf(p.help, m[1])
+			}
+		}
+		return "Unconverted value of the " + field + " report field."
+	}
+	if help, ok := gaugeHelp[name]; ok {
+		return help
+	}
+	if help, ok := sensorGaugeHelp[strings.Replace(name, "_indoor_", "_", 1)]; ok {
+		if strings.Contains(name, "_indoor_") {
+			return "Indoor " + strings.ToLower(help[:1]) + help[1:]
+		}
+		return "Outdoor " + strings.ToLower(help[:1]) + help[1:]
+	}
+	return "Value of the " + name + " measurement reported by the station."
+}
+
+// counterFieldHelp describes the counters of the fields that only increase until the device restarts.
+var counterFieldHelp = map[string]string{
+	"runtime": "Seconds that the station has been running, accumulated across restarts.",
+}
+
+// fieldCounterHelp returns the help text of the counter that a counter field is emitted as.
+func fieldCounterHelp(field string) string {
+	if help, ok := counterFieldHelp[field]; ok {
+		return help
+	}
+	return "Increase of the " + field + " report field, accumulated across resets."
+}
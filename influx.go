@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const influxMeasurement = "ecowitt"
+
+// lineProtocolEscaper escapes the characters that are special in line protocol tag keys, tag values, and field keys.
+var lineProtocolEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxForwarder writes each report to InfluxDB as a single line protocol point.
+type influxForwarder struct {
+	writeUrl string
+	token    string
+	client   *http.Client
+}
+
+func newInfluxForwarder(conf *Config) *influxForwarder {
+	query := url.Values{}
+	query.Set("org", conf.InfluxOrg)
+	query.Set("bucket", conf.InfluxBucket)
+	query.Set("precision", "s")
+	return &influxForwarder{
+		writeUrl: strings.TrimSuffix(conf.InfluxURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:    conf.InfluxToken,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (f *influxForwarder) close() {}
+
+func (f *influxForwarder) send(r report) error {
+	if len(r.fields) == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, f.writeUrl, strings.NewReader(lineProtocol(r)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if f.token != "" {
+		req.Header.Set("Authorization", "Token "+f.token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+		// client errors mean the write itself was refused, other than the timeouts and rate limits that may pass
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return &permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// lineProtocol encodes the report as a single InfluxDB line protocol point with the station labels as tags. Empty
+// labels, such as the source ip when it is omitted, are left out since line protocol does not allow empty tag values.
+func lineProtocol(r report) string {
+	var buf bytes.Buffer
+	buf.WriteString(influxMeasurement)
+	station := r.station.labels()
+	for _, k := range sortedLabelNames(station) {
+		if station[k] == "" {
+			continue
+		}
+		buf.WriteString(",")
+		buf.WriteString(lineProtocolEscaper.Replace(k))
+		buf.WriteString("=")
+		buf.WriteString(lineProtocolEscaper.Replace(station[k]))
+	}
+
+	fieldNames := make([]string, 0, len(r.fields))
+	for k := range r.fields {
+		fieldNames = append(fieldNames, k)
+	}
+	sort.Strings(fieldNames)
+	for i, k := range fieldNames {
+		if i == 0 {
+			buf.WriteString(" ")
+		} else {
+			buf.WriteString(",")
+		}
+		buf.WriteString(lineProtocolEscaper.Replace(k))
+		buf.WriteString("=")
+		buf.WriteString(strconv.FormatFloat(r.fields[k], 'f', -1, 64))
+	}
+	buf.WriteString(" ")
+	buf.WriteString(strconv.FormatInt(r.time.Unix(), 10))
+	return buf.String()
+}
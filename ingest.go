@@ -0,0 +1,264 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// reportProcessor turns the fields of reports that have been parsed and authorised into gauges and passes them on to
+// the forwarders. It is shared by every handler that accepts reports so that the metrics look the same whichever
+// protocol the station uploads with.
+type reportProcessor struct {
+	metrics    *relayMetrics
+	forwarders []*queuedForwarder
+	cumulative cumulativeTracker
+	pressures  pressureHistory
+	forwarded  forwardedFields
+}
+
+// process handles a single report received from the source ip with the config that was current when the request
+// arrived. The body size and the time the request was received are only used for metrics.
+func (p *reportProcessor) process(conf *Config, sourceIp string, values url.Values, bodyBytes int, received time.Time) {
+	// capture model and station
+	station := stationLabels{
+		Model:       values.Get("model"),
+		StationType: values.Get("stationtype"),
+		SourceIP:    sourceIp,
+		StationName: conf.StationNames[values.Get("PASSKEY")],
+	}
+	if station.Model == "" {
+		station.Model = "unknown"
+	}
+	if station.StationType == "" {
+		station.StationType = "unknown"
+	}
+	if station.StationName == "" {
+		station.StationName = "unknown"
+	}
+
+	reportTime, hasReportTime := parseDateUtc(values.Get("dateutc"))
+	if !hasReportTime {
+		reportTime = time.Now()
+	} else if conf.ClockSkewThreshold > 0 {
+		skew := time.Since(reportTime)
+		p.metrics.updateClockSkew(station, skew)
+		if skew > time.Duration(conf.ClockSkewThreshold) || -skew > time.Duration(conf.ClockSkewThreshold) {
+			zap.S().Warnw("station clock is skewed from server time", "station", station.StationName, "source_ip", station.SourceIP, "skew", skew)
+		}
+	}
+
+	// drop some fields we know aren't needed
+	for _, s := range conf.dropFields() {
+		values.Del(s)
+	}
+	for key := range values {
+		if !conf.fieldAllowed(key) {
+			values.Del(key)
+		}
+	}
+
+	p.metrics.incrementReportCount(station)
+	p.metrics.updateLabelledGauge(station, "station_info", prometheus.Labels{"firmware": firmwareVersion(station.StationType)}, 1)
+	p.metrics.observeReportSize(station, bodyBytes, len(values))
+	p.metrics.incrementReportsProcessed()
+
+	// construct gauges and emit values
+	parsed := make(map[string]float64, len(values))
+	for left, right := range values {
+		// a field repeated in the report is resolved by keeping the first value, matching url.Values.Get
+		if len(right) > 1 {
+			zap.S().Warnf("report contains %d values for %s, using the first: %v", len(right), left, right)
+			p.metrics.incrementDuplicateField(station, left)
+		}
+		rightValue, ok := parseFieldValue(right[0])
+		if !ok {
+			if conf.isTextField(left) {
+				zap.S().Debugf("skipping non-numeric value for text field %s: '%s'", left, right)
+				continue
+			}
+			zap.S().Warnf("failed to parse numeric value for %s: '%s'", left, right)
+			p.metrics.incrementParseErrors(station, left)
+			continue
+		}
+		if conf.NormalizeHumidityFractions {
+			if normalized, ok := normalizeHumidityFraction(left, rightValue); ok {
+				zap.S().Debugw("normalized fractional humidity", "field", left, "value", rightValue)
+				p.metrics.incrementHumidityCorrections(station, left)
+				rightValue = normalized
+			}
+		}
+		if bounds, ok := conf.FieldBounds[left]; ok && !bounds.contains(rightValue) {
+			zap.S().Warnf("dropping out of range value for %s: %v", left, rightValue)
+			p.metrics.incrementOutOfRange(station, left)
+			continue
+		}
+		rainPeriod, isRainTotal := rainTotalPeriod(left)
+		rainAsCounter := isRainTotal && conf.RainAsCounter
+		if cumulativeFieldPattern.MatchString(left) {
+			previous, hasPrevious := p.cumulative.observe(seriesKey(left, station.labels()), rightValue)
+			reset := hasPrevious && rightValue < previous
+			if reset {
+				zap.S().Debugw("cumulative field was reset", "field", left, "previous", previous, "value", rightValue)
+				p.metrics.incrementCounterReset(station, left)
+			}
+			if rainAsCounter {
+				p.metrics.addRainfall(station, rainPeriod, cumulativeDelta(previous, hasPrevious, rightValue)*inchToMm)
+			}
+			if left == "lightning_num" {
+				p.metrics.addLightningStrikes(station, cumulativeDelta(previous, hasPrevious, rightValue))
+			}
+		}
+		if mapping, ok := conf.MetricMapping[left]; ok {
+			p.emitMapped(station, left, mapping, rightValue)
+			parsed[left] = rightValue
+			continue
+		}
+		if conf.isCounterField(left) {
+			p.emitCounter(station, left, rightValue)
+			parsed[left] = rightValue
+			continue
+		}
+		if _, isRain := millimetreField(left); !isRain || !conf.DisableRawRainGauges {
+			p.metrics.updateRawGauge(station, left, rightValue)
+		}
+		// fields that only get their raw gauge are counted so that new firmware fields can be noticed, lightning_num
+		// is mapped because it feeds the lightning strike counter
+		mapped := left == "lightning_num"
+		if name, converted, ok := convertField(left, rightValue); ok {
+			mapped = true
+			if !rainAsCounter {
+				p.metrics.updateGauge(station, name, converted)
+			}
+		}
+		if left == "solarradiation" {
+			mapped = true
+			p.metrics.updateGauge(station, "solar_radiation_wm2", solarRadiationWm2(rightValue, conf.SolarRadiationUnit))
+		}
+		if left == "lightning" {
+			mapped = true
+			p.metrics.updateGauge(station, lightningDistanceGauge, lightningDistanceKm(rightValue, conf.LightningDistanceUnit))
+		}
+		if channel, ok := temperatureChannel(left); ok {
+			mapped = true
+			if !conf.DisableTemperatureConversion {
+				p.metrics.updateLabelledGauge(station, temperatureGauge, prometheus.Labels{"channel": channel}, fahrenheitToCelsius(rightValue))
+			}
+		}
+		if channel, ok := humidityChannel(left); ok {
+			mapped = true
+			p.metrics.updateLabelledGauge(station, humidityGauge, prometheus.Labels{"channel": channel}, rightValue)
+		}
+		if sensor, low, ok := batteryLow(left, rightValue); ok {
+			mapped = true
+			p.metrics.updateLabelledGauge(station, batteryLowGauge, prometheus.Labels{"sensor": sensor}, boolGaugeValue(low))
+		}
+		if name, ok := compassFields[left]; ok {
+			mapped = true
+			sector, direction := compassSector(rightValue)
+			p.metrics.updateLabelledGauge(station, name, prometheus.Labels{"direction": direction}, float64(sector))
+		}
+		if !mapped {
+			zap.S().Debugw("field has no conversion, only emitting its raw gauge", "field", left)
+			p.metrics.incrementUnmappedField(left)
+		}
+		parsed[left] = rightValue
+	}
+
+	// emit the gauges derived from multiple fields
+	for name, value := range deriveMetrics(parsed) {
+		p.metrics.updateGauge(station, name, value)
+	}
+	if conf.SnowWaterEquivalent != nil {
+		if swe, ok := snowWaterEquivalentMm(conf.SnowWaterEquivalent, values, parsed); ok {
+			p.metrics.updateGauge(station, snowWaterEquivalentGauge, swe)
+		}
+	}
+	if conf.PressureTendency {
+		if hpa, ok := tendencyPressure(parsed); ok {
+			if tendency, ok := p.pressures.observe(seriesKey("pressure", station.labels()), reportTime, hpa); ok {
+				p.metrics.updateGauge(station, pressureTendencyGauge, tendency)
+			}
+		}
+	}
+
+	if len(p.forwarders) > 0 {
+		fields := parsed
+		if conf.ForwardMaxInterval > 0 {
+			fields = p.forwarded.changed(station, parsed, received, time.Duration(conf.ForwardMaxInterval))
+		}
+		if len(fields) > 0 {
+			forwarded := p.metrics.forwardedStation(station)
+			for _, f := range p.forwarders {
+				f.forward(report{station: forwarded, time: reportTime, fields: fields})
+			}
+		}
+	}
+	p.metrics.observeReportDuration(station, time.Since(received))
+}
+
+// parseFieldValue parses the value of a numeric report field. NaN and infinite values parse but cannot be forwarded,
+// so they are treated like any other invalid number.
+func parseFieldValue(raw string) (float64, bool) {
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+	return value, true
+}
+
+// countUsableFields returns the number of fields of the report that process would use as numeric values. It has no
+// side effects so that strict mode can reject a report before it is counted or relayed.
+func countUsableFields(conf *Config, values url.Values) int {
+	dropped := make(map[string]bool)
+	for _, s := range conf.dropFields() {
+		dropped[s] = true
+	}
+	usable := 0
+	for key, raw := range values {
+		if dropped[key] || !conf.fieldAllowed(key) || len(raw) == 0 {
+			continue
+		}
+		value, ok := parseFieldValue(raw[0])
+		if !ok {
+			continue
+		}
+		if conf.NormalizeHumidityFractions {
+			if normalized, ok := normalizeHumidityFraction(key, value); ok {
+				value = normalized
+			}
+		}
+		if bounds, ok := conf.FieldBounds[key]; ok && !bounds.contains(value) {
+			continue
+		}
+		usable++
+	}
+	return usable
+}
+
+// emitCounter emits a counter field as the <field>_total counter, advanced by the increase of the field since the
+// previous report. A decrease means the device restarted and is counted as a reset.
+func (p *reportProcessor) emitCounter(station stationLabels, field string, value float64) {
+	name := p.metrics.counterFieldName(field)
+	previous, hasPrevious := p.cumulative.observe(seriesKey(name, station.labels()), value)
+	if hasPrevious && value < previous {
+		zap.S().Debugw("counter field was reset", "field", field, "previous", previous, "value", value)
+		p.metrics.incrementCounterReset(station, field)
+	}
+	p.metrics.addFieldCounter(station, field, name, cumulativeDelta(previous, hasPrevious, value))
+}
+
+// emitMapped emits a field that has a metric mapping as the metric it describes, replacing its raw gauge and built in
+// conversions. Counters are advanced by the increase of the converted value since the previous report.
+func (p *reportProcessor) emitMapped(station stationLabels, field string, mapping MetricMapping, value float64) {
+	converted := mapping.convert(value)
+	if mapping.Type == mappingTypeCounter {
+		previous, hasPrevious := p.cumulative.observe(seriesKey(mapping.Name, station.labels()), converted)
+		p.metrics.addMappedCounter(station, field, mapping, cumulativeDelta(previous, hasPrevious, converted))
+		return
+	}
+	p.metrics.updateGauge(station, mapping.Name, converted)
+}
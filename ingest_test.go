@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testStationLabels are the labels of the station that posted a report with postReport and no station fields.
+const testStationLabels = `model="unknown",source_ip="192.0.2.1",stationType="unknown",station_name="unknown"`
+
+// postForm posts each url encoded report to the handler in turn, failing the test if any is not accepted.
+func postForm(t *testing.T, handler http.Handler, reports ...string) {
+	t.Helper()
+	for _, report := range reports {
+		if code := postReport(handler, "application/x-www-form-urlencoded", report).Code; code != http.StatusOK {
+			t.Fatalf("expected report '%s' to be accepted, got %d", report, code)
+		}
+	}
+}
+
+func TestCounterFieldResetsWhenTheDeviceReboots(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{}`))
+	// the first report only sets the baseline, then the device reboots after runtime reached 40
+	postForm(t, handler, "runtime=10", "runtime=40", "runtime=5", "runtime=8")
+
+	values := gatherValues(t, registry)
+	if actual := values["ecowitt_relay_runtime_total{"+testStationLabels+"}"]; actual != 30+5+3 {
+		t.Errorf("expected runtime_total to count the increases and the runtime since the reboot, got %v", actual)
+	}
+	if actual := values[`ecowitt_relay_counter_reset_total{field="runtime",`+testStationLabels+"}"]; actual != 1 {
+		t.Errorf("expected a single counter reset, got %v", actual)
+	}
+}
+
+func TestCounterFieldIgnoresNegativeReadings(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{}`))
+	postForm(t, handler, "runtime=5", "runtime=-1", "runtime=3")
+
+	values := gatherValues(t, registry)
+	if actual := values["ecowitt_relay_runtime_total{"+testStationLabels+"}"]; actual != 3 {
+		t.Errorf("expected runtime_total to only count the increase after the negative reading, got %v", actual)
+	}
+}
+
+func TestLightningStrikesIgnoreNegativeReadings(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{}`))
+	postForm(t, handler, "lightning_num=5", "lightning_num=-1", "lightning_num=2")
+
+	values := gatherValues(t, registry)
+	if actual := values["ecowitt_relay_lightning_strikes_total{"+testStationLabels+"}"]; actual != 2 {
+		t.Errorf("expected lightning_strikes_total to only count the strikes after the negative reading, got %v", actual)
+	}
+}
+
+func TestRainfallIgnoresNegativeRainTotals(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{"rainAsCounter": true}`))
+	postForm(t, handler, "dailyrainin=0.5", "dailyrainin=-0.1", "dailyrainin=1")
+
+	values := gatherValues(t, registry)
+	key := `ecowitt_relay_rainfall_mm_total{model="unknown",period="daily",source_ip="192.0.2.1",stationType="unknown",station_name="unknown"}`
+	if actual := values[key]; actual != inchToMm {
+		t.Errorf("expected rainfall_mm_total to only count the rain after the negative total, got %v", actual)
+	}
+}
+
+func TestMappedCounterIgnoresNegativeConvertedValues(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{"metricMapping": {
+		"yearlyrainin": {"name": "rain_yearly_inches_total", "unit": "inches", "offset": -10, "type": "counter"}
+	}}`))
+	postForm(t, handler, "yearlyrainin=15", "yearlyrainin=5", "yearlyrainin=12")
+
+	values := gatherValues(t, registry)
+	if actual := values["ecowitt_relay_rain_yearly_inches_total{"+testStationLabels+"}"]; actual != 2 {
+		t.Errorf("expected rain_yearly_inches_total to count from 0 after the negative converted value, got %v", actual)
+	}
+}
+
+func TestNonFiniteValuesAreSkipped(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{}`))
+	postForm(t, handler, "soilmoisture1=NaN&tempf=Inf&humidity=-Inf&windspeedmph=1e400")
+
+	values := gatherValues(t, registry)
+	for _, field := range []string{"soilmoisture1", "tempf", "humidity", "windspeedmph"} {
+		if actual, ok := values["ecowitt_relay_"+field+"_raw{"+testStationLabels+"}"]; ok {
+			t.Errorf("expected no raw gauge for %s, got %v", field, actual)
+		}
+		if actual := values[`ecowitt_relay_parse_errors_total{field="`+field+`",`+testStationLabels+"}"]; actual != 1 {
+			t.Errorf("expected a parse error for %s, got %v", field, actual)
+		}
+	}
+}
+
+func TestDecimalPlacesRoundsConvertedGaugesOnly(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{"decimalPlaces": 1}`))
+	postForm(t, handler, "tempf=-0.5")
+
+	values := gatherValues(t, registry)
+	if actual := values[`ecowitt_relay_temp_celsius{channel="outdoor",`+testStationLabels+"}"]; actual != -18.1 {
+		t.Errorf("expected the converted temperature to be rounded to -18.1, got %v", actual)
+	}
+	if actual := values["ecowitt_relay_tempf_raw{"+testStationLabels+"}"]; actual != -0.5 {
+		t.Errorf("expected the raw gauge to be unrounded, got %v", actual)
+	}
+}
+
+func TestSolarRadiationUnits(t *testing.T) {
+	for _, tc := range []struct {
+		unit     string
+		report   string
+		expected float64
+	}{
+		{solarUnitWm2, "solarradiation=250.5&uv=3", 250.5},
+		{solarUnitLux, "solarradiation=31675&uv=3", 31675 / luxPerWm2},
+	} {
+		t.Run(tc.unit, func(t *testing.T) {
+			handler, registry := testReportHandler(t, testConfig(t, `{"solarRadiationUnit": "`+tc.unit+`"}`))
+			postForm(t, handler, tc.report)
+
+			values := gatherValues(t, registry)
+			if actual := values["ecowitt_relay_solar_radiation_wm2{"+testStationLabels+"}"]; actual != tc.expected {
+				t.Errorf("expected solar_radiation_wm2 to be %v, got %v", tc.expected, actual)
+			}
+			if actual := values["ecowitt_relay_uv_index{"+testStationLabels+"}"]; actual != 3 {
+				t.Errorf("expected uv_index to be passed through as 3, got %v", actual)
+			}
+		})
+	}
+}
+
+func TestMetricLayouts(t *testing.T) {
+	for _, tc := range []struct {
+		layout  string
+		present []string
+		absent  []string
+	}{
+		{
+			layout: metricLayoutPerField,
+			present: []string{
+				"ecowitt_relay_humidity_raw{" + testStationLabels + "}",
+				"ecowitt_relay_dewpoint_celsius{" + testStationLabels + "}",
+			},
+			absent: []string{
+				`ecowitt_relay_measurement{measurement="humidity_raw",` + testStationLabels + "}",
+				`ecowitt_relay_measurement{measurement="dewpoint_celsius",` + testStationLabels + "}",
+			},
+		},
+		{
+			layout: metricLayoutSingleVec,
+			present: []string{
+				`ecowitt_relay_measurement{measurement="humidity_raw",` + testStationLabels + "}",
+				`ecowitt_relay_measurement{measurement="dewpoint_celsius",` + testStationLabels + "}",
+			},
+			absent: []string{
+				"ecowitt_relay_humidity_raw{" + testStationLabels + "}",
+				"ecowitt_relay_dewpoint_celsius{" + testStationLabels + "}",
+			},
+		},
+	} {
+		t.Run(tc.layout, func(t *testing.T) {
+			handler, registry := testReportHandler(t, testConfig(t, `{"metricLayout": "`+tc.layout+`"}`))
+			postForm(t, handler, "humidity=55&tempf=70")
+
+			values := gatherValues(t, registry)
+			for _, key := range tc.present {
+				if _, ok := values[key]; !ok {
+					t.Errorf("expected %s to be present, got %v", key, values)
+				}
+			}
+			if actual := values[tc.present[0]]; actual != 55 {
+				t.Errorf("expected %s to be 55, got %v", tc.present[0], actual)
+			}
+			for _, key := range tc.absent {
+				if _, ok := values[key]; ok {
+					t.Errorf("expected %s to be absent", key)
+				}
+			}
+			// gauges with labels besides the station keep their own metric in both layouts
+			if _, ok := values[`ecowitt_relay_humidity_percent{channel="outdoor",`+testStationLabels+"}"]; !ok {
+				t.Errorf("expected humidity_percent to keep its channel label, got %v", values)
+			}
+		})
+	}
+}
+
+func TestDropFieldsExtendTheMandatoryFields(t *testing.T) {
+	handler, registry := testReportHandler(t, testConfig(t, `{"dropFields": ["runtime"]}`))
+	postForm(t, handler, "PASSKEY=ABC&dateutc=2024-01-02+15:04:05&freq=868M&runtime=100&tempf=70")
+
+	values := gatherValues(t, registry)
+	for key := range values {
+		for _, dropped := range []string{"passkey", "dateutc", "freq", "runtime"} {
+			if strings.HasPrefix(key, "ecowitt_relay_"+dropped) {
+				t.Errorf("expected %s to be dropped, got %s", dropped, key)
+			}
+		}
+	}
+	for key, value := range values {
+		if strings.HasPrefix(key, "ecowitt_relay_parse_errors_total") && value > 0 {
+			t.Errorf("expected no parse errors, got %s %v", key, value)
+		}
+	}
+	if _, ok := values["ecowitt_relay_tempf_raw{"+testStationLabels+"}"]; !ok {
+		t.Errorf("expected tempf to be kept, got %v", values)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	logFormatJson    = "json"
+	logFormatConsole = "console"
+)
+
+// newLogger builds a logger writing to stderr in the given format, json or console, at the given level, one of debug,
+// info, warn, or error. The format and level are independent so that json logs can be kept at debug level too.
+func newLogger(format, level string) (*zap.Logger, error) {
+	var lvl zapcore.Level
+	switch level {
+	case "debug", "info", "warn", "error":
+		if err := lvl.Set(level); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid log level '%s': must be debug, info, warn, or error", level)
+	}
+
+	var encoderConfig zapcore.EncoderConfig
+	switch format {
+	case logFormatJson:
+		encoderConfig = zap.NewProductionEncoderConfig()
+	case logFormatConsole:
+		encoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		return nil, fmt.Errorf("invalid log format '%s': must be %s or %s", format, logFormatJson, logFormatConsole)
+	}
+
+	return zap.Config{
+		Level:            zap.NewAtomicLevelAt(lvl),
+		Encoding:         format,
+		EncoderConfig:    encoderConfig,
+		OutputPaths:      []string{"stderr"},
+		ErrorOutputPaths: []string{"stderr"},
+	}.Build()
+}
@@ -3,213 +3,293 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
-	"io"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const mainUsage = `ecowitt-data-prometheus-relay accepts a payload from an ecowitt weather station and presents the
 data on a /metrics endpoint to present to a prometheus scraper.
 
+Usage: ecowitt-data-prometheus-relay [options] [subcommand]
+
+Subcommands:
+  print-config  Load and validate the config, print the effective config as json with credentials redacted, and exit
+  parse         Run a saved report from a file or stdin through the relay, print the resulting metrics, and exit
+
+Sending SIGHUP reloads the config. Only the fields that are read for each report, such as allowedPasskeys, take
+effect without a restart.
+
 Options:
 `
 
-type Config struct {
-}
+const printConfigCommand = "print-config"
 
 func mainInner() error {
 	// Define and parse the top level cli flags - each subcommand has their own flag set too!
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	debugFlag := fs.Bool("debug", false, "Show debug logs")
-	configFlag := fs.String("config", "/config.json", "Json account config file (default: /config.json)")
+	debugFlag := fs.Bool("debug", false, "Show debug logs and enable the debug endpoints, shorthand for -log-level=debug")
+	logFormat := fs.String("log-format", logFormatJson, "Log format, either json or console")
+	logLevel := fs.String("log-level", "info", "Minimum level of the logs to show, one of debug, info, warn, or error")
+	configFlag := fs.String("config", "/config.json", "Json account config file, or a directory of *.json files merged in lexical order (default: /config.json)")
 	ttl := fs.Duration("ttl", -1, "TTL before the app restarts (default no restart)")
+	shutdownGrace := fs.Duration("shutdown-grace", 10*time.Second, "Time to wait for in-flight requests to complete when shutting down")
+	noRuntimeMetrics := fs.Bool("disable-runtime-metrics", false, "Do not expose the go_* and process_* metrics of the relay process itself")
+	listenFlag := fs.String("listen", "", "Address to listen on, overrides ECOWITT_LISTEN and listenAddress in the config (default: "+defaultListenAddress+")")
 
 	fs.Usage = func() {
 		_, _ = fmt.Fprint(os.Stderr, mainUsage)
 		fs.PrintDefaults()
+		_, _ = fmt.Fprintf(os.Stderr, "\n%s", envUsage())
 	}
 	if err := fs.Parse(os.Args[1:]); err != nil {
 		return err
 	}
-	if fs.NArg() != 0 {
+	if fs.NArg() != 0 && fs.Arg(0) != printConfigCommand && fs.Arg(0) != parseCommand {
 		fs.Usage()
 		_, _ = fmt.Fprintf(os.Stderr, "\n")
-		return fmt.Errorf("no positional arguments expected")
+		return fmt.Errorf("unknown subcommand '%s'", fs.Arg(0))
 	}
 
-	logger, _ := zap.NewProduction()
 	if *debugFlag {
-		logger, _ = zap.NewDevelopment()
+		*logLevel = "debug"
 	}
-	zap.ReplaceGlobals(logger)
-
-	conf := &Config{}
-	zap.S().Infow("loading config", "config", *configFlag)
-	confFile, err := os.Open(*configFlag)
+	logger, err := newLogger(*logFormat, *logLevel)
 	if err != nil {
+		// there is no logger to report this with yet
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
 		return err
 	}
-	defer confFile.Close()
+	zap.ReplaceGlobals(logger)
 
-	zap.S().Infow("decoding config", "config", *configFlag)
-	if err = json.NewDecoder(confFile).Decode(conf); err != nil {
+	// load is also used to reload the config on SIGHUP so that the flag overrides survive a reload
+	load := func() (*Config, error) {
+		conf, err := loadConfig(*configFlag, os.LookupEnv)
+		if err != nil {
+			return nil, err
+		}
+		configFlags{listenAddress: *listenFlag}.apply(conf)
+		if err := conf.Validate(); err != nil {
+			return nil, err
+		}
+		return conf, nil
+	}
+	conf, err := load()
+	if err != nil {
 		return err
 	}
 
-	counter := int64(0)
+	if fs.Arg(0) == printConfigCommand {
+		return printConfig(conf, fs.Args()[1:])
+	}
+	if fs.Arg(0) == parseCommand {
+		return parseSavedReport(conf, fs.Args()[1:], os.Stdin, os.Stdout)
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/data/report/", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		if request.Method != http.MethodPost {
-			zap.S().Infof("received request: %v", request.RequestURI)
-			zap.S().Infof("received headers: %v", request.Header.Clone())
-			writer.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		data, err := io.ReadAll(request.Body)
-		if err != nil {
-			zap.S().Errorw("failed to read body stream", "err", err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		zap.S().Infof("received request: %v", request.RequestURI)
-		zap.S().Infof("received headers: %v", request.Header.Clone())
-		zap.S().Infof("received report: '%v'", string(data))
-		writer.WriteHeader(http.StatusOK)
+	registry := newRegistry(!*noRuntimeMetrics)
+	metrics := newRelayMetrics(registry, conf)
+	if len(conf.ExpectedFields) > 0 {
+		metrics.preregister(conf.ExpectedFields, conf.StationNames)
+	}
 
-		values, err := url.ParseQuery(string(data))
-		if err != nil {
-			zap.S().Warnf("failed to parse as url encoded body: %v", err)
-			return
+	var forwarders []*queuedForwarder
+	if conf.MQTT != nil {
+		zap.S().Infow("forwarding reports to mqtt", "broker", conf.MQTT.BrokerURL)
+		forwarders = append(forwarders, newQueuedForwarder("mqtt", newMqttForwarder(conf.MQTT), metrics))
+	}
+	if conf.InfluxURL != "" {
+		zap.S().Infow("forwarding reports to influx", "url", conf.InfluxURL, "bucket", conf.InfluxBucket)
+		forwarders = append(forwarders, newQueuedForwarder("influx", newInfluxForwarder(conf), metrics))
+	}
+	defer func() {
+		for _, f := range forwarders {
+			f.close()
 		}
+	}()
 
-		// capture model and station
-		modelField := values.Get("model")
-		if modelField == "" {
-			modelField = "unknown"
-		}
-		stationField := values.Get("stationtype")
-		if stationField == "" {
-			stationField = "unknown"
-		}
-		sourceIp := request.Header.Get("X-Real-IP")
-		if sourceIp == "" {
-			sourceIp = "unknown"
-		}
+	relayState, err := newRelay(conf, metrics, forwarders)
+	if err != nil {
+		return err
+	}
+	if conf.UpstreamForwardURL != "" {
+		relayState.upstream = newUpstreamForwarder(conf.UpstreamForwardURL, metrics)
+		defer relayState.upstream.close()
+		zap.S().Infow("forwarding reports upstream", "url", relayState.upstream.redactedUrl)
+	}
+	// the latest report from each station is only kept when the debug endpoint is enabled
+	if *debugFlag {
+		relayState.latest = newLastReports()
+	}
 
-		// drop some fields we know aren't needed
-		for _, s := range []string{"dateutc", "PASSKEY", "model", "stationtype", "freq"} {
-			values.Del(s)
-		}
+	// handle registers the handler with every request counted by path and status code
+	mux := http.NewServeMux()
+	handle := func(path string, handler http.Handler) {
+		mux.Handle(path, metrics.instrumentHandler(path, handler))
+	}
 
-		incrementReportCount(modelField, stationField, sourceIp)
+	metricsHandler := basicAuth(conf.MetricsBasicAuth, "metrics", newMetricsHandler(registry, registry))
+	stationsHandler := basicAuth(conf.MetricsBasicAuth, "metrics", metrics.stationsHandler())
 
-		// construct gauges and emit values
-		for left, right := range values {
-			rightValue, err := strconv.ParseFloat(right[0], 64)
-			if err != nil {
-				zap.S().Warnf("failed to parse numeric value for %s: '%s'", left, right)
-				continue
-			}
-			updateGauge(modelField, stationField, sourceIp, left, rightValue)
+	// the metrics and station summaries are served on their own server when a separate address is configured
+	servers := []*managedServer{{
+		name:     "main",
+		server:   newHttpServer(conf.ListenAddress, mux, conf),
+		certFile: conf.TLSCertFile,
+		keyFile:  conf.TLSKeyFile,
+	}}
+	if conf.ClientCAFile != "" {
+		tlsConfig, err := clientCertTLSConfig(conf.ClientCAFile)
+		if err != nil {
+			return err
 		}
+		servers[0].server.TLSConfig = tlsConfig
+		zap.S().Infow("requiring client certificates", "ca", conf.ClientCAFile)
+	}
+	if conf.MetricsListenAddress != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle(conf.MetricsPath, metrics.instrumentHandler(conf.MetricsPath, metricsHandler))
+		metricsMux.Handle(stationsPath, metrics.instrumentHandler(stationsPath, stationsHandler))
+		servers = append(servers, &managedServer{
+			name:   "metrics",
+			server: newHttpServer(conf.MetricsListenAddress, metricsMux, conf),
+		})
+	} else {
+		handle(conf.MetricsPath, metricsHandler)
+		handle(stationsPath, stationsHandler)
+	}
 
-		atomic.AddInt64(&counter, 1)
+	for _, path := range conf.reportPaths() {
+		handle(path, http.HandlerFunc(relayState.handleReport))
+	}
+	if conf.EnableWUndergroundPath {
+		handle(wundergroundPath, http.HandlerFunc(relayState.handleWunderground))
+	}
+	if relayState.latest != nil {
+		handle(lastReportPath, relayState.latest)
+	}
+	handle(healthzPath, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("ok"))
+	}))
+	handle(readyzPath, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if relayState.reportCount() == 0 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = writer.Write([]byte("no reports received yet"))
+			return
+		}
+		_, _ = writer.Write([]byte("ok"))
 	}))
-	http.Handle("/", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		zap.S().Infof("received request: %v", request.RequestURI)
-		zap.S().Infof("received headers: %v", request.Header.Clone())
+	handle("/", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		zap.S().Debugf("received request: %v", request.RequestURI)
+		zap.S().Debugf("received headers: %v", request.Header.Clone())
 		writer.WriteHeader(http.StatusNotFound)
 	}))
-	addr := ":8080"
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	go reloadOnHangup(ctx, relayState.config, load)
+
+	if conf.RemoteWriteURL != "" {
+		interval := time.Duration(conf.PushInterval)
+		zap.S().Infow("pushing metrics with remote write", "interval", interval)
+		go newRemoteWriter(conf.RemoteWriteURL, registry, interval).run(ctx, interval, metrics)
+	}
+	if conf.StaleAfter > 0 {
+		go evictStaleGauges(ctx, metrics, time.Duration(conf.StaleAfter))
+	}
+
 	if int(*ttl) > 0 {
 		go func() {
-			lastIncrement := time.Now()
-			lastCount := atomic.LoadInt64(&counter)
-			timer := time.NewTicker(time.Second)
-			select {
-			case <-timer.C:
-				count := atomic.LoadInt64(&counter)
-				if count > 0 {
-					if count == lastCount {
-						if time.Since(lastIncrement) > *ttl {
-							zap.L().Info("ttl expired with no reports")
-							os.Exit(1)
-							return
-						}
-					} else {
-						lastIncrement = time.Now()
-						lastCount = count
-					}
-				}
-			case <-ctx.Done():
-				zap.L().Info("closing background routine")
-				return
+			if ttlExpired(ctx, &relayState.reports, *ttl, time.Second) {
+				zap.L().Info("ttl expired with no reports")
+				os.Exit(1)
 			}
+			zap.L().Info("closing background routine")
 		}()
 	}
 
-	zap.S().Infow("starting server", "address", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		return err
-	}
-	return nil
+	return runServers(ctx, *shutdownGrace, servers...)
 }
 
-func updateGauge(model, station, sourceIp, key string, value float64) {
-	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name:      key + "_raw",
-		Namespace: "ecowitt_relay",
-		ConstLabels: map[string]string{
-			"source_ip":   sourceIp,
-			"model":       model,
-			"stationType": station,
-		},
-	})
-	if err := prometheus.DefaultRegisterer.Register(gauge); err != nil {
-		if conflict := new(prometheus.AlreadyRegisteredError); errors.As(err, conflict) {
-			gauge = conflict.ExistingCollector.(prometheus.Gauge)
-		} else {
-			zap.L().Fatal("failed to register counter", zap.Error(err))
+// ttlExpired blocks until either the context is cancelled, returning false, or the report counter has not changed for
+// longer than the ttl, returning true. The ttl only starts counting once the first report has been received.
+func ttlExpired(ctx context.Context, counter *int64, ttl time.Duration, interval time.Duration) bool {
+	lastIncrement := time.Now()
+	lastCount := atomic.LoadInt64(counter)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			count := atomic.LoadInt64(counter)
+			if count > 0 {
+				if count == lastCount {
+					if time.Since(lastIncrement) > ttl {
+						return true
+					}
+				} else {
+					lastIncrement = time.Now()
+					lastCount = count
+				}
+			}
+		case <-ctx.Done():
+			return false
 		}
 	}
-
-	gauge.Set(value)
 }
 
-func incrementReportCount(model, station, sourceIp string) {
-	counter := prometheus.NewCounter(prometheus.CounterOpts{
-		Name:      "report_count",
-		Namespace: "ecowitt_relay",
-		ConstLabels: map[string]string{
-			"source_ip":   sourceIp,
-			"model":       model,
-			"stationType": station,
-		},
-	})
-	if err := prometheus.DefaultRegisterer.Register(counter); err != nil {
-		if conflict := new(prometheus.AlreadyRegisteredError); errors.As(err, conflict) {
-			counter = conflict.ExistingCollector.(prometheus.Counter)
-		} else {
-			zap.L().Fatal("failed to register counter", zap.Error(err))
+// evictStaleGauges periodically unregisters the gauges that have not been updated within the stale duration, and marks
+// the stations that have not reported within it as down, until the context is cancelled.
+func evictStaleGauges(ctx context.Context, metrics *relayMetrics, staleAfter time.Duration) {
+	interval := staleAfter / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if evicted := metrics.gauges.evictStale(now.Add(-staleAfter)); evicted > 0 {
+				zap.S().Infow("evicted stale gauges", "count", evicted)
+			}
+			if down := metrics.markStationsDown(now.Add(-staleAfter)); down > 0 {
+				zap.S().Infow("marked stations down after they stopped reporting", "count", down)
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
+}
 
-	counter.Inc()
+// writeReportAccepted responds to a report with 200 OK and the configured response body, which some firmware checks
+// for before it considers the upload successful.
+func writeReportAccepted(writer http.ResponseWriter, conf *Config) {
+	writer.WriteHeader(http.StatusOK)
+	if conf.ReportResponseBody != "" {
+		_, _ = writer.Write([]byte(conf.ReportResponseBody))
+	}
+}
+
+// printConfig is the print-config subcommand which writes the loaded, defaulted, and validated config to stdout with
+// its credentials redacted.
+func printConfig(conf *Config, args []string) error {
+	fs := flag.NewFlagSet(printConfigCommand, flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("no positional arguments expected")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(conf.redacted())
 }
 
 func main() {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testTtl         = 20 * time.Millisecond
+	testTtlInterval = time.Millisecond
+)
+
+func TestTtlExpiredNotBeforeFirstReport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*testTtl)
+	defer cancel()
+	var counter int64
+	if ttlExpired(ctx, &counter, testTtl, testTtlInterval) {
+		t.Fatal("expected no expiry before the first report")
+	}
+}
+
+func TestTtlExpiredNotWhileReporting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*testTtl)
+	defer cancel()
+	var counter int64
+	go func() {
+		ticker := time.NewTicker(testTtl / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				atomic.AddInt64(&counter, 1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if ttlExpired(ctx, &counter, testTtl, testTtlInterval) {
+		t.Fatal("expected no expiry while the count keeps increasing")
+	}
+}
+
+func TestTtlExpiredAfterTtl(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counter := int64(1)
+	start := time.Now()
+	if !ttlExpired(ctx, &counter, testTtl, testTtlInterval) {
+		t.Fatal("expected expiry once the count stopped increasing")
+	}
+	if elapsed := time.Since(start); elapsed < testTtl {
+		t.Errorf("expected expiry after at least %v, got %v", testTtl, elapsed)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	mappingTypeGauge   = "gauge"
+	mappingTypeCounter = "counter"
+)
+
+// MetricMapping describes the metric that a report field is emitted as in place of its raw gauge and built in
+// conversions. The value emitted is the field value multiplied by the factor and then added to the offset, so for
+// example a fahrenheit field becomes celsius with a factor of 0.5556 and an offset of -17.778.
+type MetricMapping struct {
+	// Name is the name of the metric without the namespace, for example temperature_celsius.
+	Name string `json:"name"`
+	// Unit is the unit of the converted value, which OpenMetrics requires the name to end with, before the _total
+	// suffix of a counter. It may be empty for unitless values.
+	Unit string `json:"unit"`
+	// Factor multiplies the field value, defaults to 1.
+	Factor *float64 `json:"factor"`
+	// Offset is added to the field value after it is multiplied by the factor.
+	Offset float64 `json:"offset"`
+	// Type is either "gauge" (the default) or "counter". A counter is advanced by the increases of the field, which
+	// must be a running total such as yearlyrainin, and treats a decrease as the station resetting the total. The
+	// factor of a counter must be positive, and a converted value below 0 is counted from 0.
+	Type string `json:"type"`
+}
+
+// convert applies the factor and offset of the mapping to the field value.
+func (m MetricMapping) convert(value float64) float64 {
+	return value*(*m.Factor) + m.Offset
+}
+
+// help returns the help text of the metric that the field is mapped to.
+func (m MetricMapping) help(field string) string {
+	if m.Unit == "" {
+		return fmt.Sprintf("Value of the %s report field.", field)
+	}
+	return fmt.Sprintf("Value of the %s report field in %s.", field, m.Unit)
+}
+
+// mappedGaugeHelp returns the help text of each gauge that a report field is mapped to, keyed by the gauge name.
+func mappedGaugeHelp(mappings map[string]MetricMapping) map[string]string {
+	help := make(map[string]string, len(mappings))
+	for field, m := range mappings {
+		if m.Type == mappingTypeGauge {
+			help[m.Name] = m.help(field)
+		}
+	}
+	return help
+}
+
+// loadMetricMappingFile decodes a json object mapping report fields to their MetricMapping.
+func loadMetricMappingFile(path string) (map[string]MetricMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mappings map[string]MetricMapping
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, fmt.Errorf("failed to decode metric mapping file %s: %w", path, err)
+	}
+	return mappings, nil
+}
+
+// validateMetricMappings checks that every mapping names a valid metric that follows the OpenMetrics suffix
+// conventions and that no two fields are mapped to the same metric.
+func validateMetricMappings(mappings map[string]MetricMapping) []error {
+	var errs []error
+	fields := make([]string, 0, len(mappings))
+	for k := range mappings {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	owners := make(map[string]string, len(mappings))
+	for _, field := range fields {
+		m := mappings[field]
+		if !metricNamespacePattern.MatchString(m.Name) {
+			errs = append(errs, fmt.Errorf("invalid metricMapping for '%s': name '%s' must match %s", field, m.Name, metricNamespacePattern))
+			continue
+		}
+		base := m.Name
+		switch m.Type {
+		case mappingTypeGauge:
+		case mappingTypeCounter:
+			if !strings.HasSuffix(base, "_total") {
+				errs = append(errs, fmt.Errorf("invalid metricMapping for '%s': counter name '%s' must end with _total", field, m.Name))
+			}
+			base = strings.TrimSuffix(base, "_total")
+			if m.Factor != nil && *m.Factor <= 0 {
+				errs = append(errs, fmt.Errorf("invalid metricMapping for '%s': counter factor %v must be positive", field, *m.Factor))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("invalid metricMapping for '%s': type '%s' must be %s or %s", field, m.Type, mappingTypeGauge, mappingTypeCounter))
+		}
+		if m.Unit != "" && !strings.HasSuffix(base, "_"+m.Unit) {
+			errs = append(errs, fmt.Errorf("invalid metricMapping for '%s': name '%s' must end with its unit '%s'", field, m.Name, m.Unit))
+		}
+		if owner, ok := owners[m.Name]; ok {
+			errs = append(errs, fmt.Errorf("invalid metricMapping for '%s': name '%s' is already used by '%s'", field, m.Name, owner))
+		}
+		owners[m.Name] = field
+	}
+	return errs
+}
+
+// counterRegistry holds a CounterVec for each counter name created from mapped report fields, registering each the
+// first time it is used.
+type counterRegistry struct {
+	lock       sync.Mutex
+	registerer prometheus.Registerer
+	namespace  string
+	vecs       map[string]*prometheus.CounterVec
+	// refused holds the names that could not be registered, usually because they collide with another metric.
+	refused map[string]bool
+}
+
+func newCounterRegistry(registerer prometheus.Registerer, namespace string) *counterRegistry {
+	return &counterRegistry{
+		registerer: registerer,
+		namespace:  namespace,
+		vecs:       make(map[string]*prometheus.CounterVec),
+		refused:    make(map[string]bool),
+	}
+}
+
+// add increases the labelled series of the named CounterVec by delta, creating and registering it if it does not exist
+// yet.
+func (r *counterRegistry) add(name, help string, labels prometheus.Labels, delta float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	vec, ok := r.vecs[name]
+	if !ok {
+		if r.refused[name] {
+			return
+		}
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: r.namespace,
+			Name:      name,
+			Help:      help,
+		}, sortedLabelNames(labels))
+		if err := r.registerer.Register(vec); err != nil {
+			zap.S().Errorw("failed to register counter", "name", name, "err", err)
+			r.refused[name] = true
+			return
+		}
+		r.vecs[name] = vec
+	}
+	counter, err := vec.GetMetricWith(labels)
+	if err != nil {
+		zap.S().Errorw("failed to update counter", "name", name, "err", err)
+		return
+	}
+	counter.Add(delta)
+}
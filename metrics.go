@@ -0,0 +1,820 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNamespace = "ecowitt_relay"
+	defaultRawSuffix = "_raw"
+)
+
+const (
+	// metricLayoutPerField and metricLayoutSingleVec are the ways gauges labelled only by station can be exported: as
+	// a metric per field, or as series of the single measurement gauge distinguished by the measurement label.
+	metricLayoutPerField  = "per_field"
+	metricLayoutSingleVec = "single_vec"
+
+	measurementGauge = "measurement"
+	measurementLabel = "measurement"
+)
+
+// version and commit identify the build in the build_info metric, they are set with -ldflags "-X main.version=..".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// stationLabelNames are the names of the labels that identify the station on every metric, in the order returned by
+// stationLabels.values. The source_ip label comes first so that it can be dropped by sourceIpOmit.
+var stationLabelNames = []string{"source_ip", "model", "stationType", "station_name"}
+
+// dynamicLabelNames are all the label names that the relay sets per series. Const labels are kept distinct from these
+// so that a series is never given the same label twice.
+var dynamicLabelNames = append([]string{"field", "path", "code", "channel", "sensor", "direction", "firmware", "method", "forwarder", "version", "commit", "go_version", "measurement", "period", "result"}, stationLabelNames...)
+
+// relayMetrics holds the gauges created from station reports along with the metrics describing the operation of the
+// relay itself. All of them share the configured namespace and const labels.
+type relayMetrics struct {
+	gauges              *gaugeRegistry
+	counters            *counterRegistry
+	rawSuffix           string
+	metricLayout        string
+	fieldRename         map[string]string
+	decimalPlaces       *int
+	sourceIpMode        string
+	dropReportCountIp   bool
+	stationLabelNames   []string
+	reportCount         *prometheus.CounterVec
+	lastReportTimestamp *prometheus.GaugeVec
+	stationUp           *prometheus.GaugeVec
+	stationsLock        sync.Mutex
+	stationLastSeen     map[string]stationSeen
+	clockSkew           *prometheus.GaugeVec
+	reportBodyBytes     *prometheus.HistogramVec
+	reportFields        *prometheus.HistogramVec
+	reportDuration      *prometheus.HistogramVec
+	parseErrors         *prometheus.CounterVec
+	outOfRange          *prometheus.CounterVec
+	duplicateFields     *prometheus.CounterVec
+	humidityCorrections *prometheus.CounterVec
+	counterResets       *prometheus.CounterVec
+	rainfall            *prometheus.CounterVec
+	lightningStrikes    *prometheus.CounterVec
+	rateLimitedReports  *prometheus.CounterVec
+	oversizedReports    *prometheus.CounterVec
+	rejectedMethods     *prometheus.CounterVec
+	remoteWriteFailures prometheus.Counter
+	bytesReceived       prometheus.Counter
+	reportsProcessed    prometheus.Counter
+	sanitizedFieldNames *prometheus.CounterVec
+	unmappedFields      *prometheus.CounterVec
+	forwardQueueDepth   *prometheus.GaugeVec
+	forwardDropped      *prometheus.CounterVec
+	forwardRejected     *prometheus.CounterVec
+	forwardCircuitOpen  *prometheus.GaugeVec
+	upstreamForwards    *prometheus.CounterVec
+	httpRequests        *prometheus.CounterVec
+	buildInfo           *prometheus.GaugeVec
+	startTime           prometheus.Gauge
+}
+
+// newRelayMetrics creates and registers the metrics described by the config.
+func newRelayMetrics(registerer prometheus.Registerer, conf *Config) *relayMetrics {
+	namespace := conf.Namespace
+	if len(conf.ConstLabels) > 0 {
+		registerer = prometheus.WrapRegistererWith(conf.ConstLabels, registerer)
+	}
+	// the source ip counters lose their only label along with the station metrics when the source ip is omitted
+	stationNames, sourceIpNames := stationLabelNames, []string{"source_ip"}
+	if conf.SourceIPMode == sourceIpOmit {
+		stationNames, sourceIpNames = stationLabelNames[1:], nil
+	}
+	reportCountNames := stationNames
+	if conf.ReportCountWithoutSourceIp {
+		reportCountNames = stationLabelNames[1:]
+	}
+	factory := promauto.With(registerer)
+	m := &relayMetrics{
+		gauges:            newGaugeRegistry(registerer, namespace, *conf.RawSuffix, mappedGaugeHelp(conf.MetricMapping)),
+		counters:          newCounterRegistry(registerer, namespace),
+		rawSuffix:         *conf.RawSuffix,
+		metricLayout:      conf.MetricLayout,
+		fieldRename:       conf.FieldRename,
+		decimalPlaces:     conf.DecimalPlaces,
+		sourceIpMode:      conf.SourceIPMode,
+		dropReportCountIp: conf.ReportCountWithoutSourceIp,
+		stationLabelNames: stationNames,
+		reportCount: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "report_count",
+			Help:      "Number of reports received from the station.",
+		}, reportCountNames),
+		stationUp: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "station_up",
+			Help:      "1 when the station has reported within staleAfter and 0 once it has not, always 1 without staleAfter.",
+		}, stationNames),
+		stationLastSeen: make(map[string]stationSeen),
+		lastReportTimestamp: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_report_timestamp_seconds",
+			Help:      "Unix time in seconds of the most recent report received from the station.",
+		}, stationNames),
+		clockSkew: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "clock_skew_seconds",
+			Help:      "Seconds that the dateutc of the most recent report from the station lags behind the server time.",
+		}, stationNames),
+		reportBodyBytes: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "report_body_bytes",
+			Help:      "Size in bytes of the report bodies received from the station.",
+			Buckets:   prometheus.ExponentialBuckets(64, 2, 9),
+		}, stationNames),
+		reportFields: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "report_fields",
+			Help:      "Number of fields in each report from the station after dropped and disallowed fields are removed.",
+			Buckets:   prometheus.LinearBuckets(10, 10, 10),
+		}, stationNames),
+		reportDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "report_duration_seconds",
+			Help:      "Seconds taken to handle each report from the station, from receiving the request to queueing it for the forwarders.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+		}, stationNames),
+		parseErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "parse_errors_total",
+			Help:      "Number of report fields whose value could not be parsed as a finite number.",
+		}, append([]string{"field"}, stationNames...)),
+		outOfRange: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "out_of_range_total",
+			Help:      "Number of report field values dropped for being outside the configured field bounds.",
+		}, append([]string{"field"}, stationNames...)),
+		duplicateFields: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "duplicate_field_total",
+			Help:      "Number of times a field appeared more than once in a report, only the first value is used.",
+		}, append([]string{"field"}, stationNames...)),
+		humidityCorrections: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "humidity_fraction_corrections_total",
+			Help:      "Number of humidity values reported as a fraction that were multiplied by 100 to form a percentage.",
+		}, append([]string{"field"}, stationNames...)),
+		counterResets: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "counter_reset_total",
+			Help:      "Number of times a cumulative field such as yearlyrainin decreased, indicating the station reset it.",
+		}, append([]string{"field"}, stationNames...)),
+		rainfall: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rainfall_mm_total",
+			Help:      "Millimetres of rain measured by the station, accumulated from the increases of each rain total field when rainAsCounter is set.",
+		}, append([]string{"period"}, stationNames...)),
+		lightningStrikes: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      lightningStrikesCounter,
+			Help:      "Number of lightning strikes detected by the station, accumulated from the increases of lightning_num.",
+		}, stationNames),
+		rateLimitedReports: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_reports_total",
+			Help:      "Number of reports dropped because the client ip exceeded maxReportsPerMinute, labelled with the peer address unless it is a trusted proxy.",
+		}, sourceIpNames),
+		oversizedReports: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "oversized_reports_total",
+			Help:      "Number of reports dropped because the body exceeded maxBodyBytes, labelled with the peer address unless it is a trusted proxy.",
+		}, sourceIpNames),
+		rejectedMethods: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_method_total",
+			Help:      "Number of requests to a report path rejected for using a method that the path does not accept.",
+		}, []string{"method"}),
+		bytesReceived: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_received_total",
+			Help:      "Number of report bytes received from every station, after any decompression.",
+		}),
+		reportsProcessed: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reports_processed_total",
+			Help:      "Number of reports from every station that were accepted and processed.",
+		}),
+		remoteWriteFailures: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "remote_write_failures_total",
+			Help:      "Number of pushes to the remoteWriteUrl that failed.",
+		}),
+		unmappedFields: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "unmapped_fields_total",
+			Help:      "Number of report fields without a conversion or metric mapping that were only emitted as a raw gauge.",
+		}, []string{"field"}),
+		sanitizedFieldNames: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sanitized_field_names_total",
+			Help:      "Number of times a report field name had to be altered to form a valid metric name.",
+		}, []string{"field"}),
+		forwardQueueDepth: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "forward_queue_depth",
+			Help:      "Number of reports waiting to be sent by the forwarder.",
+		}, []string{"forwarder"}),
+		forwardDropped: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "forward_dropped_total",
+			Help:      "Number of reports dropped by the forwarder because its queue was full, every attempt to send them failed, its circuit breaker was open, or the relay shut down.",
+		}, []string{"forwarder"}),
+		forwardRejected: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "forward_rejected_total",
+			Help:      "Number of reports dropped by the forwarder without retrying because the downstream rejected them.",
+		}, []string{"forwarder"}),
+		forwardCircuitOpen: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "forward_circuit_open",
+			Help:      "Whether the circuit breaker of the forwarder is open, 1 while reports are dropped without being sent because the downstream keeps failing.",
+		}, []string{"forwarder"}),
+		upstreamForwards: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_forwards_total",
+			Help:      "Number of reports replayed to the upstreamForwardUrl, by result: success, failure, or dropped because the queue was full or the relay shut down.",
+		}, []string{"result"}),
+		httpRequests: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of http requests handled by the relay by handler path and status code.",
+		}, []string{"path", "code"}),
+		buildInfo: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "build_info",
+			Help:      "Always 1, labelled with the version and commit of the relay and the go version it was built with.",
+		}, []string{"version", "commit", "go_version"}),
+		startTime: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "start_time_seconds",
+			Help:      "Unix time in seconds that the relay started at.",
+		}),
+	}
+	m.buildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+	m.startTime.SetToCurrentTime()
+	return m
+}
+
+var (
+	invalidMetricNameChars = regexp.MustCompile(`[^a-z0-9_]`)
+	repeatedUnderscores    = regexp.MustCompile(`__+`)
+)
+
+// stationLabels identify the station that a report was received from and are attached to every metric it produces.
+type stationLabels struct {
+	Model       string
+	StationType string
+	SourceIP    string
+	StationName string
+}
+
+func (s stationLabels) values() []string {
+	return []string{s.SourceIP, s.Model, s.StationType, s.StationName}
+}
+
+// reportCountValues returns the label values of report_count, which may leave out the source ip that the other
+// station metrics have.
+func (m *relayMetrics) reportCountValues(s stationLabels) []string {
+	values := m.stationValues(s)
+	if m.dropReportCountIp && m.sourceIpMode != sourceIpOmit {
+		return values[1:]
+	}
+	return values
+}
+
+// stationValues returns the values of the station labels as they appear on the metrics, with the source ip hashed or
+// omitted according to the source ip mode.
+func (m *relayMetrics) stationValues(s stationLabels) []string {
+	values := s.values()
+	switch m.sourceIpMode {
+	case sourceIpHashed:
+		values[0] = hashSourceIp(values[0])
+	case sourceIpOmit:
+		values = values[1:]
+	}
+	return values
+}
+
+// forwardedStation returns the station with its source ip hashed or cleared according to the source ip mode, so that
+// the forwarders publish the same station values as the metrics.
+func (m *relayMetrics) forwardedStation(s stationLabels) stationLabels {
+	switch m.sourceIpMode {
+	case sourceIpHashed:
+		s.SourceIP = hashSourceIp(s.SourceIP)
+	case sourceIpOmit:
+		s.SourceIP = ""
+	}
+	return s
+}
+
+// stationLabels is like stationValues but returns the station labels by name.
+func (m *relayMetrics) stationLabels(s stationLabels) prometheus.Labels {
+	labels := make(prometheus.Labels, len(m.stationLabelNames))
+	for i, v := range m.stationValues(s) {
+		labels[m.stationLabelNames[i]] = v
+	}
+	return labels
+}
+
+// sourceIpValues returns the label values of the metrics that are only labelled by source ip.
+func (m *relayMetrics) sourceIpValues(sourceIp string) []string {
+	switch m.sourceIpMode {
+	case sourceIpHashed:
+		return []string{hashSourceIp(sourceIp)}
+	case sourceIpOmit:
+		return nil
+	}
+	return []string{sourceIp}
+}
+
+func (s stationLabels) labels() prometheus.Labels {
+	labels := make(prometheus.Labels, len(stationLabelNames))
+	for i, v := range s.values() {
+		labels[stationLabelNames[i]] = v
+	}
+	return labels
+}
+
+// preregister creates the report counter and the raw gauges of the expected fields at zero for each station named in
+// the config, or a single unknown station when there are none, so that the metrics exist before the first report. The
+// remaining station labels are unknown until a report arrives, which creates new series alongside these.
+func (m *relayMetrics) preregister(expectedFields []string, stationNames map[string]string) {
+	names := make(map[string]bool, len(stationNames))
+	for _, name := range stationNames {
+		names[name] = true
+	}
+	if len(names) == 0 {
+		names["unknown"] = true
+	}
+	for name := range names {
+		station := stationLabels{Model: "unknown", StationType: "unknown", SourceIP: "unknown", StationName: name}
+		m.reportCount.WithLabelValues(m.reportCountValues(station)...)
+		for _, field := range expectedFields {
+			m.setStationGauge(m.rawGaugeName(field), true, m.stationLabels(station), 0)
+		}
+	}
+}
+
+// instrumentHandler wraps the handler registered at the path so that every request it serves is counted by status
+// code.
+func (m *relayMetrics) instrumentHandler(path string, handler http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerCounter(m.httpRequests.MustCurryWith(prometheus.Labels{"path": path}), handler)
+}
+
+// sanitizeMetricName converts a report field name into a valid metric name by lower casing it, replacing invalid
+// characters with underscores, collapsing repeated underscores, and prefixing an underscore when it starts with a
+// digit.
+func sanitizeMetricName(key string) string {
+	name := invalidMetricNameChars.ReplaceAllString(strings.ToLower(key), "_")
+	name = repeatedUnderscores.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// rawGaugeName returns the name of the gauge that holds the unconverted value of a report field. A field renamed in the
+// config uses the new name as is, without the raw suffix. Any alteration needed to make the name valid is counted so
+// that surprising field names can be audited.
+func (m *relayMetrics) rawGaugeName(key string) string {
+	if renamed, ok := m.fieldRename[key]; ok {
+		return sanitizeMetricName(renamed)
+	}
+	name := sanitizeMetricName(key)
+	if name != key {
+		zap.S().Debugw("sanitized field name", "field", key, "name", name)
+		m.sanitizedFieldNames.WithLabelValues(key).Inc()
+	}
+	return name + m.rawSuffix
+}
+
+// boolGaugeValue returns 1 for true and 0 for false.
+func boolGaugeValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (m *relayMetrics) updateGauge(station stationLabels, name string, value float64) {
+	m.setStationGauge(name, false, m.stationLabels(station), m.round(value))
+}
+
+// round rounds a converted or derived value to the configured number of decimal places, leaving it alone when no
+// rounding is configured.
+func (m *relayMetrics) round(value float64) float64 {
+	if m.decimalPlaces == nil {
+		return value
+	}
+	return roundToPlaces(value, *m.decimalPlaces)
+}
+
+// updateRawGauge sets the gauge holding the unconverted value of a report field. The raw gauge gives way to any
+// converted or derived gauge of the same name.
+func (m *relayMetrics) updateRawGauge(station stationLabels, key string, value float64) {
+	m.setStationGauge(m.rawGaugeName(key), true, m.stationLabels(station), value)
+}
+
+// updateLabelledGauge is like updateGauge but adds the extra labels to the gauge alongside the station labels. These
+// gauges keep their own name in every metric layout since their label names differ.
+func (m *relayMetrics) updateLabelledGauge(station stationLabels, name string, extra prometheus.Labels, value float64) {
+	labels := m.stationLabels(station)
+	for k, v := range extra {
+		labels[k] = v
+	}
+	m.gauges.set(name, name, false, labels, m.round(value))
+}
+
+// setStationGauge sets a gauge labelled only by station, which the single_vec layout turns into a series of the
+// measurement gauge.
+func (m *relayMetrics) setStationGauge(name string, raw bool, labels prometheus.Labels, value float64) {
+	if m.metricLayout == metricLayoutSingleVec {
+		labels[measurementLabel] = name
+		m.gauges.set(measurementGauge, name, raw, labels, value)
+		return
+	}
+	m.gauges.set(name, name, raw, labels, value)
+}
+
+// counterFieldName returns the name of the counter that a counter field is emitted as.
+func (m *relayMetrics) counterFieldName(field string) string {
+	return sanitizeMetricName(field) + "_total"
+}
+
+// addFieldCounter advances the counter of a counter field.
+func (m *relayMetrics) addFieldCounter(station stationLabels, field, name string, delta float64) {
+	m.counters.add(name, fieldCounterHelp(field), m.stationLabels(station), delta)
+}
+
+// addMappedCounter advances the counter that a report field is mapped to.
+func (m *relayMetrics) addMappedCounter(station stationLabels, field string, mapping MetricMapping, delta float64) {
+	m.counters.add(mapping.Name, mapping.help(field), m.stationLabels(station), delta)
+}
+
+func (m *relayMetrics) incrementReportCount(station stationLabels) {
+	m.reportCount.WithLabelValues(m.reportCountValues(station)...).Inc()
+	m.lastReportTimestamp.WithLabelValues(m.stationValues(station)...).SetToCurrentTime()
+	m.markStationUp(station, time.Now())
+}
+
+// stationSeen is when a station last reported, along with the label values of its station_up series.
+type stationSeen struct {
+	values []string
+	at     time.Time
+}
+
+func (m *relayMetrics) markStationUp(station stationLabels, at time.Time) {
+	values := m.stationValues(station)
+	m.stationsLock.Lock()
+	defer m.stationsLock.Unlock()
+	m.stationLastSeen[seriesKey("station_up", m.stationLabels(station))] = stationSeen{values: values, at: at}
+	m.stationUp.WithLabelValues(values...).Set(1)
+}
+
+// markStationsDown sets station_up to 0 for every station that has not reported since the given time and returns how
+// many stations that was. The series are kept, unlike the stale gauges, so that alerts can fire on them.
+func (m *relayMetrics) markStationsDown(before time.Time) int {
+	m.stationsLock.Lock()
+	defer m.stationsLock.Unlock()
+	down := 0
+	for key, seen := range m.stationLastSeen {
+		if seen.at.Before(before) {
+			m.stationUp.WithLabelValues(seen.values...).Set(0)
+			delete(m.stationLastSeen, key)
+			down++
+		}
+	}
+	return down
+}
+
+func (m *relayMetrics) observeReportSize(station stationLabels, bodyBytes, fields int) {
+	m.reportBodyBytes.WithLabelValues(m.stationValues(station)...).Observe(float64(bodyBytes))
+	m.reportFields.WithLabelValues(m.stationValues(station)...).Observe(float64(fields))
+}
+
+func (m *relayMetrics) observeReportDuration(station stationLabels, duration time.Duration) {
+	m.reportDuration.WithLabelValues(m.stationValues(station)...).Observe(duration.Seconds())
+}
+
+func (m *relayMetrics) updateClockSkew(station stationLabels, skew time.Duration) {
+	m.clockSkew.WithLabelValues(m.stationValues(station)...).Set(skew.Seconds())
+}
+
+func (m *relayMetrics) incrementRateLimited(sourceIp string) {
+	m.rateLimitedReports.WithLabelValues(m.sourceIpValues(sourceIp)...).Inc()
+}
+
+func (m *relayMetrics) incrementDuplicateField(station stationLabels, field string) {
+	m.duplicateFields.WithLabelValues(append([]string{field}, m.stationValues(station)...)...).Inc()
+}
+
+func (m *relayMetrics) incrementHumidityCorrections(station stationLabels, field string) {
+	m.humidityCorrections.WithLabelValues(append([]string{field}, m.stationValues(station)...)...).Inc()
+}
+
+func (m *relayMetrics) incrementCounterReset(station stationLabels, field string) {
+	m.counterResets.WithLabelValues(append([]string{field}, m.stationValues(station)...)...).Inc()
+}
+
+func (m *relayMetrics) addRainfall(station stationLabels, period string, mm float64) {
+	m.rainfall.WithLabelValues(append([]string{period}, m.stationValues(station)...)...).Add(mm)
+}
+
+func (m *relayMetrics) addBytesReceived(bytes int) {
+	m.bytesReceived.Add(float64(bytes))
+}
+
+func (m *relayMetrics) incrementReportsProcessed() {
+	m.reportsProcessed.Inc()
+}
+
+func (m *relayMetrics) incrementRemoteWriteFailures() {
+	m.remoteWriteFailures.Inc()
+}
+
+func (m *relayMetrics) addUpstreamForwards(result string, n int) {
+	m.upstreamForwards.WithLabelValues(result).Add(float64(n))
+}
+
+func (m *relayMetrics) addLightningStrikes(station stationLabels, strikes float64) {
+	m.lightningStrikes.WithLabelValues(m.stationValues(station)...).Add(strikes)
+}
+
+func (m *relayMetrics) incrementUnmappedField(field string) {
+	m.unmappedFields.WithLabelValues(field).Inc()
+}
+
+func (m *relayMetrics) incrementOversized(sourceIp string) {
+	m.oversizedReports.WithLabelValues(m.sourceIpValues(sourceIp)...).Inc()
+}
+
+// knownMethods are the http methods counted under their own name by incrementRejectedMethod, anything else is counted
+// as "other" so that scanners cannot create unbounded label values.
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+func (m *relayMetrics) incrementRejectedMethod(method string) {
+	if !knownMethods[method] {
+		method = "other"
+	}
+	m.rejectedMethods.WithLabelValues(method).Inc()
+}
+
+func (m *relayMetrics) incrementParseErrors(station stationLabels, field string) {
+	m.parseErrors.WithLabelValues(append([]string{field}, m.stationValues(station)...)...).Inc()
+}
+
+func (m *relayMetrics) incrementOutOfRange(station stationLabels, field string) {
+	m.outOfRange.WithLabelValues(append([]string{field}, m.stationValues(station)...)...).Inc()
+}
+
+// gaugeRegistry holds a GaugeVec for each gauge name created from station reports and tracks when each labelled
+// series was last updated so that series belonging to stations that have stopped reporting can be deleted.
+type gaugeRegistry struct {
+	lock       sync.Mutex
+	registerer prometheus.Registerer
+	namespace  string
+	// rawSuffix is stripped from the names of raw gauges to find the report field that their help text describes.
+	rawSuffix string
+	// help holds the help text of the gauges that do not use the generated one.
+	help map[string]string
+	vecs map[string]*prometheus.GaugeVec
+	// raw holds whether each measurement contains unconverted field values rather than converted or derived ones.
+	raw map[string]bool
+	// refused holds the names that could not be registered, usually because they collide with another metric.
+	refused map[string]bool
+	series  map[string]*trackedSeries
+}
+
+type trackedSeries struct {
+	name        string
+	measurement string
+	labels      prometheus.Labels
+	value       float64
+	lastUpdated time.Time
+}
+
+func newGaugeRegistry(registerer prometheus.Registerer, namespace, rawSuffix string, help map[string]string) *gaugeRegistry {
+	return &gaugeRegistry{
+		registerer: registerer,
+		namespace:  namespace,
+		rawSuffix:  rawSuffix,
+		help:       help,
+		vecs:       make(map[string]*prometheus.GaugeVec),
+		raw:        make(map[string]bool),
+		refused:    make(map[string]bool),
+		series:     make(map[string]*trackedSeries),
+	}
+}
+
+// set updates the value of the labelled series of the named GaugeVec, creating and registering it if it does not exist
+// yet. The first call for a name determines the label names of its GaugeVec. The measurement is what the series
+// represents, which is the GaugeVec name unless several measurements share a GaugeVec, and raw marks measurements
+// holding unconverted field values. When a raw and a converted measurement share a name the converted one wins,
+// replacing the raw one if that was created first.
+func (r *gaugeRegistry) set(name, measurement string, raw bool, labels prometheus.Labels, value float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if wasRaw, ok := r.raw[measurement]; ok && wasRaw != raw {
+		if raw {
+			return
+		}
+		zap.S().Warnw("raw gauge collides with a converted gauge, dropping the raw gauge", "name", measurement)
+		r.deleteMeasurement(measurement)
+	}
+	vec, ok := r.vecs[name]
+	if !ok {
+		if r.refused[name] {
+			return
+		}
+		help, ok := r.help[name]
+		if !ok {
+			help = fieldGaugeHelp(name, measurement, raw, r.rawSuffix)
+		}
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: r.namespace,
+			Name:      name,
+			Help:      help,
+		}, sortedLabelNames(labels))
+		if err := r.registerer.Register(vec); err != nil {
+			zap.S().Errorw("failed to register gauge", "name", name, "err", err)
+			r.refused[name] = true
+			return
+		}
+		r.vecs[name] = vec
+	}
+	gauge, err := vec.GetMetricWith(labels)
+	if err != nil {
+		zap.S().Errorw("failed to update gauge", "name", name, "err", err)
+		return
+	}
+	gauge.Set(value)
+	r.raw[measurement] = raw
+
+	key := seriesKey(name, labels)
+	tracked, ok := r.series[key]
+	if !ok {
+		tracked = &trackedSeries{name: name, measurement: measurement, labels: labels}
+		r.series[key] = tracked
+	}
+	tracked.value = value
+	tracked.lastUpdated = time.Now()
+}
+
+// snapshot returns a copy of every tracked series.
+func (r *gaugeRegistry) snapshot() []trackedSeries {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	series := make([]trackedSeries, 0, len(r.series))
+	for _, tracked := range r.series {
+		series = append(series, *tracked)
+	}
+	return series
+}
+
+// evictStale deletes all the series that have not been updated since the given time and returns how many were
+// removed.
+func (r *gaugeRegistry) evictStale(before time.Time) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	evicted := 0
+	for key, tracked := range r.series {
+		if tracked.lastUpdated.Before(before) {
+			r.vecs[tracked.name].Delete(tracked.labels)
+			delete(r.series, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// deleteMeasurement deletes every series of the measurement, and unregisters its GaugeVec if it has its own. The lock
+// must be held.
+func (r *gaugeRegistry) deleteMeasurement(measurement string) {
+	for key, tracked := range r.series {
+		if tracked.measurement == measurement {
+			r.vecs[tracked.name].Delete(tracked.labels)
+			delete(r.series, key)
+		}
+	}
+	if vec, ok := r.vecs[measurement]; ok {
+		r.registerer.Unregister(vec)
+		delete(r.vecs, measurement)
+	}
+	delete(r.raw, measurement)
+}
+
+func sortedLabelNames(labels prometheus.Labels) []string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// seriesKey builds a unique key from the name and labels of a series.
+func seriesKey(name string, labels prometheus.Labels) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, k := range sortedLabelNames(labels) {
+		sb.WriteString("\x00")
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(labels[k])
+	}
+	return sb.String()
+}
+
+// newRegistry creates the registry that the metrics of the relay are registered with. Unlike the default registry the
+// go_* and process_* metrics describing the relay process are only included when runtimeMetrics is set, so that the
+// metrics served are the same in every environment.
+func newRegistry(runtimeMetrics bool) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	if runtimeMetrics {
+		registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	return registry
+}
+
+// newMetricsHandler serves the metrics of the gatherer, negotiating the OpenMetrics format with scrapers that ask for
+// it in their Accept header and falling back to the text format for the others. OpenMetrics requires counters to end
+// in _total so report_count is typed as unknown in that format. Like promhttp.Handler the scrapes are instrumented
+// with the promhttp_metric_handler_* metrics registered with the registerer. A station query parameter limits the
+// scrape to the series of the station with that station_name, for scrapers that scrape each station separately.
+func newMetricsHandler(registerer prometheus.Registerer, gatherer prometheus.Gatherer) http.Handler {
+	opts := promhttp.HandlerOpts{EnableOpenMetrics: true}
+	all := promhttp.HandlerFor(gatherer, opts)
+	return promhttp.InstrumentMetricHandler(registerer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if station := r.URL.Query().Get("station"); station != "" {
+			promhttp.HandlerFor(&stationGatherer{gatherer: gatherer, station: station}, opts).ServeHTTP(w, r)
+			return
+		}
+		all.ServeHTTP(w, r)
+	}))
+}
+
+// stationGatherer gathers only the series of the gatherer with the station_name label of the station. When no series
+// has that station name, such as for a misspelt or not yet reported station, every series is gathered as if there was
+// no filter.
+type stationGatherer struct {
+	gatherer prometheus.Gatherer
+	station  string
+}
+
+func (g *stationGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	if err != nil {
+		return families, err
+	}
+	filtered := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			if hasLabel(metric, "station_name", g.station) {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) > 0 {
+			filtered = append(filtered, &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type, Metric: metrics})
+		}
+	}
+	if len(filtered) == 0 {
+		return families, nil
+	}
+	return filtered, nil
+}
+
+// hasLabel returns whether the metric has the label with the value.
+func hasLabel(metric *dto.Metric, name, value string) bool {
+	for _, pair := range metric.GetLabel() {
+		if pair.GetName() == name {
+			return pair.GetValue() == value
+		}
+	}
+	return false
+}
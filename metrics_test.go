@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	for key, expected := range map[string]string{
+		// known ecowitt fields are already valid and kept as is
+		"tempf":            "tempf",
+		"tempinf":          "tempinf",
+		"humidity":         "humidity",
+		"baromrelin":       "baromrelin",
+		"windspeedmph":     "windspeedmph",
+		"solarradiation":   "solarradiation",
+		"dailyrainin":      "dailyrainin",
+		"soilmoisture1":    "soilmoisture1",
+		"pm25_ch1":         "pm25_ch1",
+		"pm25_avg_24h_ch1": "pm25_avg_24h_ch1",
+		"tf_co2":           "tf_co2",
+		"wh65batt":         "wh65batt",
+		"lightning_num":    "lightning_num",
+		// and the ones with upper case letters are lower cased
+		"PASSKEY": "passkey",
+		"tempinF": "tempinf",
+		// anything else is made valid
+		"wh25.batt":       "wh25_batt",
+		"Solar Radiation": "solar_radiation",
+		"temp-1--f":       "temp_1_f",
+		"a__b":            "a_b",
+		"1wire":           "_1wire",
+		"":                "_",
+		"température":     "temp_rature",
+	} {
+		if actual := sanitizeMetricName(key); actual != expected {
+			t.Errorf("sanitizeMetricName(%q): expected %q, got %q", key, expected, actual)
+		}
+	}
+}
+
+func TestMetricsHandlerNegotiatesFormat(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Namespace: defaultNamespace, Name: "test_total", Help: "Test counter."})
+	registry.MustRegister(counter)
+	counter.Add(3)
+	handler := newMetricsHandler(registry, registry)
+
+	for _, tc := range []struct {
+		name        string
+		accept      string
+		contentType string
+		eof         bool
+	}{
+		{"openmetrics", "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", "application/openmetrics-text", true},
+		{"text", "", "text/plain; version=0.0.4", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, defaultMetricsPath, nil)
+			if tc.accept != "" {
+				request.Header.Set("Accept", tc.accept)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, tc.contentType) {
+				t.Errorf("expected content type %s, got %s", tc.contentType, contentType)
+			}
+			body, _ := io.ReadAll(recorder.Body)
+			if !strings.Contains(string(body), "ecowitt_relay_test_total 3") {
+				t.Errorf("expected the counter in the body, got %s", body)
+			}
+			if eof := strings.HasSuffix(string(body), "# EOF\n"); eof != tc.eof {
+				t.Errorf("expected the body to end with # EOF to be %v, got %s", tc.eof, body)
+			}
+		})
+	}
+}
+
+// describingRegisterer records the descriptions of every collector registered with it.
+type describingRegisterer struct {
+	*prometheus.Registry
+	descs []*prometheus.Desc
+}
+
+func (r *describingRegisterer) Register(c prometheus.Collector) error {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		r.descs = append(r.descs, desc)
+	}
+	return r.Registry.Register(c)
+}
+
+func (r *describingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// descVariableLabelPattern extracts the variable label names from the string form of a prometheus.Desc, which is the
+// only way they are exposed.
+var descVariableLabelPattern = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*) `)
+
+func TestDynamicLabelNamesCoverEveryMetric(t *testing.T) {
+	reserved := make(map[string]bool, len(dynamicLabelNames))
+	for _, name := range dynamicLabelNames {
+		reserved[name] = true
+	}
+	registerer := &describingRegisterer{Registry: prometheus.NewRegistry()}
+	handler, err := newReportHandler(testConfig(t, `{"counterFields": ["runtime"]}`), registerer)
+	if err != nil {
+		t.Fatalf("failed to create report handler: %v", err)
+	}
+	// a report with fields of every kind so that the gauges created on demand are registered too
+	postReport(handler, "application/x-www-form-urlencoded", "PASSKEY=ABC&stationtype=GW1100B_V2.3.5&model=GW1100B&dateutc=2024-01-02+15:04:05&"+
+		"tempf=70&tempinf=68&temp1f=65&humidity=55&humidityin=45&humidity1=50&baromrelin=29.9&baromabsin=29.8&"+
+		"winddir=180&windspeedmph=3&windgustmph=5&solarradiation=100&uv=2&dailyrainin=0.1&yearlyrainin=10&"+
+		"soilmoisture1=30&pm25_ch1=5&lightning=12&lightning_num=2&wh65batt=0&runtime=100&custom=1")
+
+	if len(registerer.descs) == 0 {
+		t.Fatal("expected the relay to register metrics")
+	}
+	for _, desc := range registerer.descs {
+		description := desc.String()
+		_, variable, _ := strings.Cut(description, "variableLabels: ")
+		for _, match := range descVariableLabelPattern.FindAllStringSubmatch(variable, -1) {
+			if !reserved[match[1]] {
+				t.Errorf("label '%s' of %s is missing from dynamicLabelNames", match[1], description)
+			}
+		}
+	}
+}
+
+func TestConstLabelsMustNotClash(t *testing.T) {
+	for _, name := range dynamicLabelNames {
+		if errs := validateConstLabels(map[string]string{name: "x"}); len(errs) != 1 {
+			t.Errorf("expected const label '%s' to be rejected, got %v", name, errs)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+const defaultMqttTopicPrefix = "ecowitt"
+
+// mqttTopicEscaper replaces the characters that separate topic levels or are wildcards, which must not appear within a
+// level of a published topic.
+var mqttTopicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_", "\x00", "_")
+
+// mqttPublishTimeout is how long to wait for the broker to acknowledge each message before the report is retried.
+const mqttPublishTimeout = 5 * time.Second
+
+// mqttForwarder publishes each parsed report field as a json message to an MQTT broker. The client reconnects in the
+// background when the broker goes away.
+type mqttForwarder struct {
+	client mqtt.Client
+	prefix string
+}
+
+// mqttMessage is the json payload published for each field.
+type mqttMessage struct {
+	Value       float64   `json:"value"`
+	Model       string    `json:"model"`
+	StationType string    `json:"stationType"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+func newMqttForwarder(conf *MQTTConfig) *mqttForwarder {
+	opts := mqtt.NewClientOptions().
+		AddBroker(conf.BrokerURL).
+		SetClientID(conf.ClientID).
+		SetUsername(conf.Username).
+		SetPassword(conf.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(mqtt.Client) {
+			zap.S().Infow("connected to mqtt broker", "broker", conf.BrokerURL)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			zap.S().Warnw("lost connection to mqtt broker", "broker", conf.BrokerURL, "err", err)
+		})
+	client := mqtt.NewClient(opts)
+	// with connect retry enabled this token only completes once connected, so don't wait for it
+	client.Connect()
+
+	prefix := strings.TrimSuffix(conf.TopicPrefix, "/")
+	if prefix == "" {
+		prefix = defaultMqttTopicPrefix
+	}
+	return &mqttForwarder{client: client, prefix: prefix}
+}
+
+// mqttStationLevel returns the topic level of the station. Stations without a configured name are told apart by their
+// model and source ip, which is hashed or left out according to the source ip mode, so that they do not all publish to
+// the same topics.
+func mqttStationLevel(s stationLabels) string {
+	level := s.StationName
+	if level == "unknown" {
+		level += "-" + s.Model
+		if s.SourceIP != "" {
+			level += "-" + s.SourceIP
+		}
+	}
+	return mqttTopicEscaper.Replace(level)
+}
+
+// send publishes every field of the report to <prefix>/<station level>/<field>.
+func (f *mqttForwarder) send(r report) error {
+	if !f.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to mqtt broker")
+	}
+	station := mqttStationLevel(r.station)
+	for field, value := range r.fields {
+		payload, err := json.Marshal(mqttMessage{
+			Value:       value,
+			Model:       r.station.Model,
+			StationType: r.station.StationType,
+			SourceIP:    r.station.SourceIP,
+			Time:        r.time,
+		})
+		if err != nil {
+			zap.S().Errorw("failed to encode mqtt message", "field", field, "err", err)
+			continue
+		}
+		token := f.client.Publish(fmt.Sprintf("%s/%s/%s", f.prefix, station, mqttTopicEscaper.Replace(field)), 0, false, payload)
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			return fmt.Errorf("timed out publishing %s to mqtt broker", field)
+		}
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("failed to publish %s to mqtt broker: %w", field, err)
+		}
+	}
+	return nil
+}
+
+func (f *mqttForwarder) close() {
+	f.client.Disconnect(250)
+}
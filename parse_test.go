@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func TestParseSavedReport(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write([]byte("PASSKEY=ABC&tempf=70.2"))
+	_ = gz.Close()
+
+	for _, tc := range []struct {
+		name     string
+		config   string
+		args     []string
+		report   string
+		expected string
+		err      string
+	}{
+		{"form", `{}`, nil, "PASSKEY=ABC&tempf=70.2\n", `ecowitt_relay_tempf_raw`, ""},
+		{"json", `{}`, []string{"-content-type", "application/json"}, `{"PASSKEY":"ABC","tempf":70.2}`, `ecowitt_relay_tempf_raw`, ""},
+		{"gzip", `{}`, []string{"-content-encoding", "gzip"}, gzipped.String(), `ecowitt_relay_tempf_raw`, ""},
+		{"source ip", `{}`, []string{"-source-ip", "10.0.0.1"}, "tempf=70.2", `source_ip="10.0.0.1"`, ""},
+		{"unknown passkey", `{"allowedPasskeys": ["XYZ"]}`, nil, "PASSKEY=ABC&tempf=70.2", "", "status 401"},
+		{"too large", `{"maxBodyBytes": 8}`, nil, "PASSKEY=ABC&tempf=70.2", "", "status 413"},
+		{"outside the allowed cidrs", `{"allowedCidrs": ["10.0.0.0/8"]}`, []string{"-source-ip", "192.0.2.1"}, "tempf=70.2", "", "status 403"},
+		{"strict parse", `{"strictParse": true}`, nil, "model=GW1100B", "", "status 400"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := parseSavedReport(testConfig(t, tc.config), tc.args, strings.NewReader(tc.report), &out)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse report: %v", err)
+			}
+			if !strings.Contains(out.String(), tc.expected) {
+				t.Errorf("expected the output to contain %q, got %s", tc.expected, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// pressureTendencyPeriod is the interval that the pressure tendency is measured over, the period used by
+	// synoptic weather reports.
+	pressureTendencyPeriod = 3 * time.Hour
+	// pressureTendencyTolerance is how much older than the period the earlier reading may be, allowing for missed
+	// reports, before the tendency is considered unknown.
+	pressureTendencyTolerance = 15 * time.Minute
+	pressureTendencyGauge     = "pressure_tendency_hpa_3h"
+)
+
+// pressureSample is a barometric pressure reading in hPa.
+type pressureSample struct {
+	time time.Time
+	hpa  float64
+}
+
+// pressureHistory remembers the recent barometric pressure readings of each station so that the change over the
+// tendency period can be computed. Only the readings needed to find the one from a period ago are kept. The zero
+// value is ready to use.
+type pressureHistory struct {
+	lock    sync.Mutex
+	samples map[string][]pressureSample
+}
+
+// observe records the reading of the series identified by key and returns the change in hPa since the reading from
+// one tendency period earlier. The final return value is false when there is not yet enough history, or the earlier
+// reading is missing because the station stopped reporting for a while.
+func (h *pressureHistory) observe(key string, at time.Time, hpa float64) (float64, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.samples == nil {
+		h.samples = make(map[string][]pressureSample)
+	}
+	samples := h.samples[key]
+	// readings that arrive out of order would corrupt the history so they are ignored
+	if n := len(samples); n > 0 && !at.After(samples[n-1].time) {
+		return 0, false
+	}
+	samples = append(samples, pressureSample{time: at, hpa: hpa})
+
+	// the reference is the newest reading at least a period old, anything older than it is no longer needed
+	cutoff := at.Add(-pressureTendencyPeriod)
+	reference := -1
+	for i, s := range samples {
+		if s.time.After(cutoff) {
+			break
+		}
+		reference = i
+	}
+	if reference > 0 {
+		samples = append(samples[:0], samples[reference:]...)
+		reference = 0
+	}
+	h.samples[key] = samples
+	if reference < 0 || samples[reference].time.Before(cutoff.Add(-pressureTendencyTolerance)) {
+		return 0, false
+	}
+	return hpa - samples[reference].hpa, true
+}
+
+// tendencyPressure returns the pressure in hPa that the tendency is computed from, preferring the absolute pressure
+// and falling back to the relative one since they differ by a constant for a given station.
+func tendencyPressure(parsed map[string]float64) (float64, bool) {
+	if value, ok := parsed["baromabsin"]; ok {
+		return value * inHgToHpa, true
+	}
+	if value, ok := parsed["baromrelin"]; ok {
+		return value * inHgToHpa, true
+	}
+	return 0, false
+}
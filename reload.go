@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// hotReloadFields are the json names of the config fields that take effect when the config is reloaded on SIGHUP,
+// since they are read from the live config for every report. Every other field is only read at startup, so changing
+// it requires a restart: this includes the listen addresses, tls, report path, basic auth, metric naming and labels,
+// trusted proxies, rate limit, staleness, and the forwarders. The help text of gauges that already exist is not
+// updated when their metricMapping changes.
+var hotReloadFields = map[string]bool{
+	"strictParse":                  true,
+	"reportResponseBody":           true,
+	"maxBodyBytes":                 true,
+	"metricMappingFile":            true,
+	"metricMapping":                true,
+	"disableTemperatureConversion": true,
+	"disableRawRainGauges":         true,
+	"rainAsCounter":                true,
+	"pressureTendency":             true,
+	"normalizeHumidityFractions":   true,
+	"solarRadiationUnit":           true,
+	"lightningDistanceUnit":        true,
+	"snowWaterEquivalent":          true,
+	"allowedPasskeys":              true,
+	"stationNames":                 true,
+	"allowFields":                  true,
+	"dropFields":                   true,
+	"textFields":                   true,
+	"counterFields":                true,
+	"fieldBounds":                  true,
+	"clockSkewThreshold":           true,
+	"forwardMaxInterval":           true,
+}
+
+// reloadOnHangup reloads the config with load every time the process receives SIGHUP until the context is cancelled.
+// A config that fails to load or validate is rejected and the live config is kept.
+func reloadOnHangup(ctx context.Context, live *atomic.Pointer[Config], load func() (*Config, error)) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-hangup:
+			conf, err := load()
+			if err != nil {
+				zap.S().Errorw("rejected reloaded config, keeping the current config", "err", err)
+				continue
+			}
+			reloaded, ignored := changedConfigFields(live.Load(), conf)
+			live.Store(conf)
+			zap.S().Infow("reloaded config", "changed", reloaded)
+			if len(ignored) > 0 {
+				zap.S().Warnw("reloaded config changes fields that only take effect after a restart", "fields", ignored)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// changedConfigFields compares two configs and returns the json names of the fields that differ, split into those
+// that take effect on reload and those that need a restart.
+func changedConfigFields(previous, next *Config) (reloaded []string, ignored []string) {
+	pv, nv := reflect.ValueOf(previous).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < pv.NumField(); i++ {
+		field := pv.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" || reflect.DeepEqual(pv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if hotReloadFields[name] {
+			reloaded = append(reloaded, name)
+		} else {
+			ignored = append(ignored, name)
+		}
+	}
+	return reloaded, ignored
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultPushInterval is how often the metrics are pushed when remoteWriteUrl is set without a pushInterval.
+const defaultPushInterval = Duration(time.Minute)
+
+// remoteWriter pushes every metric of the gatherer to a Prometheus remote write endpoint, for relays that the
+// Prometheus server cannot reach to scrape.
+type remoteWriter struct {
+	url string
+	// redactedUrl is the url with any password removed so that it can be logged.
+	redactedUrl string
+	gatherer    prometheus.Gatherer
+	client      *http.Client
+}
+
+func newRemoteWriter(rawUrl string, gatherer prometheus.Gatherer, interval time.Duration) *remoteWriter {
+	return &remoteWriter{
+		url:         rawUrl,
+		redactedUrl: redactUrl(rawUrl),
+		gatherer:    gatherer,
+		client:      &http.Client{Timeout: interval},
+	}
+}
+
+// run pushes the metrics every interval until the context is cancelled. Failed pushes are logged and counted and the
+// values are not retried, since the next push carries newer values of the same series.
+func (w *remoteWriter) run(ctx context.Context, interval time.Duration, metrics *relayMetrics) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := w.push(now); err != nil {
+				zap.S().Warnw("failed to push metrics with remote write", "url", w.redactedUrl, "err", err)
+				metrics.incrementRemoteWriteFailures()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *remoteWriter) push(now time.Time) error {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(snappyEncode(encodeWriteRequest(families, now))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// remoteWriteSeries is a single sample of a time series, with its labels including __name__.
+type remoteWriteSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+// flattenFamily expands a metric family into the series that a scrape of it would produce, so that histograms and
+// summaries become their _bucket, _sum, and _count series.
+func flattenFamily(family *dto.MetricFamily) []remoteWriteSeries {
+	name := family.GetName()
+	var out []remoteWriteSeries
+	for _, metric := range family.GetMetric() {
+		labels := func(suffix string, extra ...string) map[string]string {
+			l := map[string]string{"__name__": name + suffix}
+			for _, pair := range metric.GetLabel() {
+				l[pair.GetName()] = pair.GetValue()
+			}
+			for i := 0; i+1 < len(extra); i += 2 {
+				l[extra[i]] = extra[i+1]
+			}
+			return l
+		}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			out = append(out, remoteWriteSeries{labels(""), metric.GetCounter().GetValue()})
+		case dto.MetricType_GAUGE:
+			out = append(out, remoteWriteSeries{labels(""), metric.GetGauge().GetValue()})
+		case dto.MetricType_UNTYPED:
+			out = append(out, remoteWriteSeries{labels(""), metric.GetUntyped().GetValue()})
+		case dto.MetricType_HISTOGRAM:
+			h := metric.GetHistogram()
+			for _, b := range h.GetBucket() {
+				out = append(out, remoteWriteSeries{labels("_bucket", "le", formatFloatLabel(b.GetUpperBound())), float64(b.GetCumulativeCount())})
+			}
+			if buckets := h.GetBucket(); len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), 1) {
+				out = append(out, remoteWriteSeries{labels("_bucket", "le", "+Inf"), float64(h.GetSampleCount())})
+			}
+			out = append(out,
+				remoteWriteSeries{labels("_sum"), h.GetSampleSum()},
+				remoteWriteSeries{labels("_count"), float64(h.GetSampleCount())},
+			)
+		case dto.MetricType_SUMMARY:
+			s := metric.GetSummary()
+			for _, q := range s.GetQuantile() {
+				out = append(out, remoteWriteSeries{labels("", "quantile", formatFloatLabel(q.GetQuantile())), q.GetValue()})
+			}
+			out = append(out,
+				remoteWriteSeries{labels("_sum"), s.GetSampleSum()},
+				remoteWriteSeries{labels("_count"), float64(s.GetSampleCount())},
+			)
+		}
+	}
+	return out
+}
+
+func formatFloatLabel(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes the families as a remote write WriteRequest protobuf with every sample at the given
+// time. The messages are small enough that they are written with protowire directly rather than generated code:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	timestamp := now.UnixMilli()
+	var buf []byte
+	for _, family := range families {
+		for _, series := range flattenFamily(family) {
+			var ts []byte
+			// remote write receivers require the labels to be sorted by name
+			names := make([]string, 0, len(series.labels))
+			for k := range series.labels {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			for _, k := range names {
+				var label []byte
+				label = protowire.AppendTag(label, 1, protowire.BytesType)
+				label = protowire.AppendString(label, k)
+				label = protowire.AppendTag(label, 2, protowire.BytesType)
+				label = protowire.AppendString(label, series.labels[k])
+				ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+				ts = protowire.AppendBytes(ts, label)
+			}
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(series.value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(timestamp))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sample)
+
+			buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+			buf = protowire.AppendBytes(buf, ts)
+		}
+	}
+	return buf
+}
+
+// snappyEncode encodes the data in the snappy block format that remote write requires. It only emits literals, which
+// every snappy decoder accepts, trading compression for not needing a snappy dependency. The payloads are small and
+// pushed infrequently so the lack of compression is not a concern.
+func snappyEncode(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	// each literal is limited to 64KiB, the size of the blocks that snappy encoders compress independently
+	const maxLiteral = 1 << 16
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		if n <= 60 {
+			out = append(out, byte(n-1)<<2)
+		} else {
+			// longer literals use tag 61 followed by their length minus one as 2 little endian bytes
+			out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// snappyDecode decodes a snappy block made only of literals, which is all that snappyEncode emits.
+func snappyDecode(t *testing.T, data []byte) []byte {
+	t.Helper()
+	length, n := binary.Uvarint(data)
+	if n <= 0 {
+		t.Fatalf("invalid snappy length")
+	}
+	data = data[n:]
+	var out []byte
+	for len(data) > 0 {
+		tag := data[0]
+		if tag&3 != 0 {
+			t.Fatalf("unexpected snappy copy tag %#x", tag)
+		}
+		size, header := int(tag>>2)+1, 1
+		switch tag >> 2 {
+		case 60:
+			size, header = int(data[1])+1, 2
+		case 61:
+			size, header = int(binary.LittleEndian.Uint16(data[1:3]))+1, 3
+		case 62, 63:
+			t.Fatalf("unexpected snappy literal tag %#x", tag)
+		}
+		if header+size > len(data) {
+			t.Fatalf("snappy literal of %d bytes overruns the block", size)
+		}
+		out = append(out, data[header:header+size]...)
+		data = data[header+size:]
+	}
+	if uint64(len(out)) != length {
+		t.Fatalf("expected %d decoded bytes, got %d", length, len(out))
+	}
+	return out
+}
+
+func TestSnappyEncodeGolden(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 100)
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected []byte
+	}{
+		{"empty", nil, []byte{0x00}},
+		{"short literal", []byte("hello"), append([]byte{0x05, 4 << 2}, "hello"...)},
+		{"long literal", long, append([]byte{0x64, 61 << 2, 99, 0}, long...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := snappyEncode(tc.data); !bytes.Equal(actual, tc.expected) {
+				t.Errorf("expected %x, got %x", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSnappyEncodeRoundTrip(t *testing.T) {
+	for _, size := range []int{1, 60, 61, 1 << 16, 1<<16 + 1, 200000} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		if actual := snappyDecode(t, snappyEncode(data)); !bytes.Equal(actual, data) {
+			t.Errorf("size %d: decoded data does not match", size)
+		}
+	}
+}
+
+// decodedSeries is a time series of a decoded WriteRequest with its single sample.
+type decodedSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// consumeMessage returns the fields of a protobuf message by number, failing the test on malformed input.
+func consumeMessage(t *testing.T, data []byte) map[protowire.Number][][]byte {
+	t.Helper()
+	fields := make(map[protowire.Number][][]byte)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		data = data[n:]
+		size := protowire.ConsumeFieldValue(num, typ, data)
+		if size < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(size))
+		}
+		value := data[:size]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		fields[num] = append(fields[num], value)
+		data = data[size:]
+	}
+	return fields
+}
+
+// decodeWriteRequest decodes the WriteRequest described by encodeWriteRequest.
+func decodeWriteRequest(t *testing.T, data []byte) []decodedSeries {
+	t.Helper()
+	var out []decodedSeries
+	for _, ts := range consumeMessage(t, data)[1] {
+		fields := consumeMessage(t, ts)
+		series := decodedSeries{labels: make(map[string]string)}
+		previous := ""
+		for _, raw := range fields[1] {
+			label := consumeMessage(t, raw)
+			name, value := string(label[1][0]), string(label[2][0])
+			if name <= previous {
+				t.Errorf("expected the labels to be sorted, got %s after %s", name, previous)
+			}
+			previous = name
+			series.labels[name] = value
+		}
+		if len(fields[2]) != 1 {
+			t.Fatalf("expected a single sample, got %d", len(fields[2]))
+		}
+		sample := consumeMessage(t, fields[2][0])
+		bits, _ := protowire.ConsumeFixed64(sample[1][0])
+		timestamp, _ := protowire.ConsumeVarint(sample[2][0])
+		series.value, series.timestamp = math.Float64frombits(bits), int64(timestamp)
+		out = append(out, series)
+	}
+	return out
+}
+
+func TestEncodeWriteRequestGolden(t *testing.T) {
+	families := []*dto.MetricFamily{{
+		Name:   stringPointer("g"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: float64Pointer(1)}}},
+	}}
+	expected := []byte{
+		0x0a, 0x1d, // timeseries
+		0x0a, 0x0d, // label
+		0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+		0x12, 0x01, 'g',
+		0x12, 0x0c, // sample
+		0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f,
+		0x10, 0xe8, 0x07,
+	}
+	if actual := encodeWriteRequest(families, time.UnixMilli(1000)); !bytes.Equal(actual, expected) {
+		t.Errorf("expected %x, got %x", expected, actual)
+	}
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+func float64Pointer(f float64) *float64 {
+	return &f
+}
+
+// testRemoteWriteRegistry returns a registry with a labelled gauge, a counter, a histogram, and a summary.
+func testRemoteWriteRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "temp_celsius", Help: "t"}, []string{"station_name"})
+	gauge.WithLabelValues("garden").Set(21.5)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "reports_total", Help: "r"})
+	counter.Add(3)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "size_bytes", Help: "s", Buckets: []float64{1, 2}})
+	histogram.Observe(1.5)
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{Name: "duration_seconds", Help: "d", Objectives: map[float64]float64{0.5: 0.05}})
+	summary.Observe(4)
+	registry.MustRegister(gauge, counter, histogram, summary)
+	return registry
+}
+
+// seriesValues keys the value of each series by its labels.
+func seriesValues(series []decodedSeries) map[string]float64 {
+	values := make(map[string]float64, len(series))
+	for _, s := range series {
+		values[fmt.Sprint(s.labels)] = s.value
+	}
+	return values
+}
+
+func TestRemoteWritePushRoundTrip(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	now := time.UnixMilli(1700000000123)
+	if err := newRemoteWriter(server.URL, testRemoteWriteRegistry(), time.Second).push(now); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	series := decodeWriteRequest(t, snappyDecode(t, <-bodies))
+	for _, s := range series {
+		if s.timestamp != now.UnixMilli() {
+			t.Errorf("expected every sample at %d, got %d for %v", now.UnixMilli(), s.timestamp, s.labels)
+		}
+	}
+	expected := map[string]float64{
+		fmt.Sprint(map[string]string{"__name__": "temp_celsius", "station_name": "garden"}): 21.5,
+		fmt.Sprint(map[string]string{"__name__": "reports_total"}):                          3,
+		fmt.Sprint(map[string]string{"__name__": "size_bytes_bucket", "le": "1"}):           0,
+		fmt.Sprint(map[string]string{"__name__": "size_bytes_bucket", "le": "2"}):           1,
+		fmt.Sprint(map[string]string{"__name__": "size_bytes_bucket", "le": "+Inf"}):        1,
+		fmt.Sprint(map[string]string{"__name__": "size_bytes_sum"}):                         1.5,
+		fmt.Sprint(map[string]string{"__name__": "size_bytes_count"}):                       1,
+		fmt.Sprint(map[string]string{"__name__": "duration_seconds", "quantile": "0.5"}):    4,
+		fmt.Sprint(map[string]string{"__name__": "duration_seconds_sum"}):                   4,
+		fmt.Sprint(map[string]string{"__name__": "duration_seconds_count"}):                 1,
+	}
+	if actual := seriesValues(series); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateUtcLayouts are the accepted layouts of the dateutc field. Stations send "2024-01-02+15:04:05" where the + is
+// usually decoded to a space by the form parsing, but json bodies and some proxies preserve it.
+var dateUtcLayouts = []string{"2006-01-02 15:04:05", "2006-01-02+15:04:05", time.RFC3339}
+
+// stationTypeVersionPattern matches the firmware version suffix of a stationtype such as GW1100B_V2.3.5.
+var stationTypeVersionPattern = regexp.MustCompile(`[_-]?[Vv](\d+(?:\.\d+)*)$`)
+
+// firmwareVersion extracts the firmware version from the stationtype, returning "unknown" when it has no version.
+func firmwareVersion(stationType string) string {
+	if m := stationTypeVersionPattern.FindStringSubmatch(stationType); m != nil {
+		return m[1]
+	}
+	return "unknown"
+}
+
+// maxDecompressedBodyBytes limits how large a gzip compressed body may expand to, guarding against decompression bombs.
+const maxDecompressedBodyBytes = 1 << 20
+
+// invalidBodyError is returned when the request body could not be decoded because of a problem with the body itself,
+// rather than the connection, and the client should be told that the request was bad.
+type invalidBodyError struct {
+	err error
+}
+
+func (e *invalidBodyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidBodyError) Unwrap() error {
+	return e.err
+}
+
+// classifyBodyReadError marks errors caused by a truncated or malformed chunked body as invalid so that the client
+// gets a 400 rather than the 500 used for other failures of the body stream. The net/http chunked reader does not
+// export its error values so malformed chunking can only be recognised by the message.
+func classifyBodyReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || strings.Contains(err.Error(), "chunk") {
+		return &invalidBodyError{fmt.Errorf("truncated or invalid body: %w", err)}
+	}
+	return err
+}
+
+// readReportBody reads the full request body, decompressing it first when it has a gzip Content-Encoding. Chunked
+// bodies without a Content-Length are read the same way, up to the limit set on the request body.
+func readReportBody(request *http.Request) ([]byte, error) {
+	if !strings.EqualFold(strings.TrimSpace(request.Header.Get("Content-Encoding")), "gzip") {
+		data, err := io.ReadAll(request.Body)
+		if err != nil {
+			return nil, classifyBodyReadError(err)
+		}
+		return data, nil
+	}
+	gz, err := gzip.NewReader(request.Body)
+	if err != nil {
+		return nil, &invalidBodyError{fmt.Errorf("failed to decompress gzip body: %w", err)}
+	}
+	defer gz.Close()
+	data, err := io.ReadAll(io.LimitReader(gz, maxDecompressedBodyBytes+1))
+	if err != nil {
+		return nil, &invalidBodyError{fmt.Errorf("failed to decompress gzip body: %w", err)}
+	}
+	if len(data) > maxDecompressedBodyBytes {
+		return nil, &invalidBodyError{fmt.Errorf("decompressed body exceeds %d bytes", maxDecompressedBodyBytes)}
+	}
+	return data, nil
+}
+
+// parseReport decodes the body of a report into its fields. Json bodies are flattened into the same shape as the
+// url encoded form bodies that ecowitt stations send so that both go through the same gauge pipeline.
+func parseReport(contentType string, data []byte) (url.Values, error) {
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" {
+		return parseJsonReport(data)
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return values, fmt.Errorf("invalid url encoded body: %w", err)
+	}
+	return values, nil
+}
+
+func parseJsonReport(data []byte) (url.Values, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	raw := make(map[string]interface{})
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid json body: %w", err)
+	}
+	values := make(url.Values, len(raw))
+	for k, v := range raw {
+		flattenJsonValue(values, k, v)
+	}
+	return values, nil
+}
+
+// flattenJsonValue adds the json value to the fields under the given key. Nested objects and arrays are flattened with
+// their keys or indexes joined by underscores.
+func flattenJsonValue(values url.Values, key string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			flattenJsonValue(values, key+"_"+k, inner)
+		}
+	case []interface{}:
+		for i, inner := range v {
+			flattenJsonValue(values, key+"_"+strconv.Itoa(i), inner)
+		}
+	case json.Number:
+		values.Add(key, v.String())
+	case string:
+		values.Add(key, v)
+	case nil:
+	default:
+		values.Add(key, fmt.Sprint(v))
+	}
+}
+
+// parseDateUtc parses the time that the station took the report at from the dateutc field. The final return value is
+// false when the field is missing or invalid.
+func parseDateUtc(raw string) (time.Time, bool) {
+	raw = strings.TrimSpace(raw)
+	for _, layout := range dateUtcLayouts {
+		if t, err := time.ParseInLocation(layout, raw, time.UTC); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReportDateUtc(t *testing.T) {
+	expected := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		// the exact body an ecowitt station sends, where the form decoding turns the + into a space
+		{"form plus", "application/x-www-form-urlencoded", "PASSKEY=ABC&stationtype=GW1100B_V2.3.5&dateutc=2024-01-02+15:04:05&tempf=70.2&model=GW1100B"},
+		{"form encoded plus", "application/x-www-form-urlencoded", "PASSKEY=ABC&dateutc=2024-01-02%2B15:04:05&tempf=70.2"},
+		{"form encoded space", "application/x-www-form-urlencoded", "PASSKEY=ABC&dateutc=2024-01-02%2015:04:05&tempf=70.2"},
+		{"json plus", "application/json", `{"PASSKEY":"ABC","dateutc":"2024-01-02+15:04:05","tempf":70.2}`},
+		{"json space", "application/json", `{"PASSKEY":"ABC","dateutc":"2024-01-02 15:04:05","tempf":70.2}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			values, err := parseReport(tc.contentType, []byte(tc.body))
+			if err != nil {
+				t.Fatalf("failed to parse report: %v", err)
+			}
+			actual, ok := parseDateUtc(values.Get("dateutc"))
+			if !ok {
+				t.Fatalf("failed to parse dateutc '%s'", values.Get("dateutc"))
+			}
+			if !actual.Equal(expected) {
+				t.Errorf("expected %v, got %v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseDateUtcInvalid(t *testing.T) {
+	for _, raw := range []string{"", "now", "2024-01-02", "2024-13-02 15:04:05"} {
+		if actual, ok := parseDateUtc(raw); ok {
+			t.Errorf("expected '%s' to be invalid, got %v", raw, actual)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// unixAddressPrefix marks a listen address as the path of a unix domain socket rather than a host:port.
+	unixAddressPrefix = "unix:"
+	// unixSocketMode allows a reverse proxy running as another user in the same group to connect to the socket.
+	unixSocketMode = 0o660
+)
+
+// unixSocketPath returns the socket path of a unix:<path> listen address.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixAddressPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixAddressPrefix), true
+}
+
+// listenUnix listens on the unix domain socket at the path, replacing a socket left behind by a previous run that did
+// not shut down cleanly. The socket file is removed again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("refusing to replace %s: not a unix socket", path)
+		}
+		zap.S().Infow("removing stale unix socket", "path", path)
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale unix socket: %w", err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(true)
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set unix socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// newHttpServer creates an http server with the timeouts from the config so that slow clients cannot hold
+// connections open indefinitely.
+func newHttpServer(addr string, handler http.Handler, conf *Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(conf.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(conf.ReadTimeout),
+		WriteTimeout:      time.Duration(conf.WriteTimeout),
+	}
+}
+
+// clientCertTLSConfig returns a tls config that requires clients to present a certificate signed by one of the CA
+// certificates in the PEM encoded bundle at the path.
+func clientCertTLSConfig(caFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("client ca file %s contains no PEM encoded certificates", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// managedServer is an http server run by runServers, optionally serving tls when a certificate and key are set.
+type managedServer struct {
+	name     string
+	server   *http.Server
+	certFile string
+	keyFile  string
+}
+
+func (s *managedServer) serve() error {
+	if path, ok := unixSocketPath(s.server.Addr); ok {
+		listener, err := listenUnix(path)
+		if err != nil {
+			return err
+		}
+		if s.certFile != "" {
+			zap.S().Infow("starting tls server", "server", s.name, "socket", path, "cert", s.certFile)
+			return s.server.ServeTLS(listener, s.certFile, s.keyFile)
+		}
+		zap.S().Infow("starting server", "server", s.name, "socket", path)
+		return s.server.Serve(listener)
+	}
+	if s.certFile != "" {
+		zap.S().Infow("starting tls server", "server", s.name, "address", s.server.Addr, "cert", s.certFile)
+		return s.server.ListenAndServeTLS(s.certFile, s.keyFile)
+	}
+	zap.S().Infow("starting server", "server", s.name, "address", s.server.Addr)
+	return s.server.ListenAndServe()
+}
+
+// runServers starts all the servers and blocks until either one of them fails or the context is cancelled. All the
+// servers are then shut down together, waiting up to the grace period for in-flight requests to complete.
+func runServers(ctx context.Context, grace time.Duration, servers ...*managedServer) error {
+	serverErr := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *managedServer) {
+			if err := s.serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- fmt.Errorf("%s server failed: %w", s.name, err)
+			}
+		}(s)
+	}
+
+	var runErr error
+	select {
+	case runErr = <-serverErr:
+	case <-ctx.Done():
+	}
+
+	zap.S().Infow("shutting down servers", "grace", grace)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), grace)
+	defer cancelShutdown()
+	var wg sync.WaitGroup
+	shutdownErrs := make([]error, len(servers))
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s *managedServer) {
+			defer wg.Done()
+			if err := s.server.Shutdown(shutdownCtx); err != nil {
+				shutdownErrs[i] = fmt.Errorf("failed to shutdown %s server: %w", s.name, err)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	if err := errors.Join(append([]error{runErr}, shutdownErrs...)...); err != nil {
+		return err
+	}
+	zap.S().Info("server shutdown complete")
+	return nil
+}
+
+// basicAuth wraps the handler so that requests must present the configured credentials with http basic auth. When
+// auth is nil the handler is returned unwrapped.
+func basicAuth(auth *BasicAuthConfig, realm string, handler http.Handler) http.Handler {
+	if auth == nil {
+		return handler
+	}
+	expectedHash, _ := hex.DecodeString(auth.PasswordSha256)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		username, password, ok := request.BasicAuth()
+		passwordHash := sha256.Sum256([]byte(password))
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+		passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], expectedHash) == 1
+		if !ok || !usernameMatch || !passwordMatch {
+			writer.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm))
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+const (
+	snowWaterEquivalentGauge      = "snow_water_equivalent_mm"
+	defaultSnowPrecipitationField = "dailyrainin"
+)
+
+// SnowConfig enables the snow_water_equivalent_mm gauge for stations that report the type of precipitation in one
+// of their fields. Ecowitt stations measure melted snow with the same rain gauge so the snow water equivalent is the
+// accumulated precipitation while the type field says it is snowing.
+type SnowConfig struct {
+	// PrecipitationTypeField is the report field holding the type of precipitation.
+	PrecipitationTypeField string `json:"precipitationTypeField"`
+	// SnowValues are the values of the precipitation type field that mean snow, compared case insensitively. Any
+	// other value is treated as rain and sets the gauge to 0.
+	SnowValues []string `json:"snowValues"`
+	// PrecipitationField is the accumulated precipitation field in inches, defaults to dailyrainin.
+	PrecipitationField string `json:"precipitationField"`
+}
+
+// isSnow returns whether the precipitation type value means snow.
+func (c *SnowConfig) isSnow(value string) bool {
+	for _, snow := range c.SnowValues {
+		if strings.EqualFold(strings.TrimSpace(value), snow) {
+			return true
+		}
+	}
+	return false
+}
+
+// snowWaterEquivalentMm returns the snow water equivalent in millimetres from the raw report values and the parsed
+// numeric fields. The final return value is false when the report lacks either the precipitation type or the
+// precipitation field, so that stations without them emit nothing.
+func snowWaterEquivalentMm(c *SnowConfig, values url.Values, parsed map[string]float64) (float64, bool) {
+	precipitationType := values.Get(c.PrecipitationTypeField)
+	if precipitationType == "" {
+		return 0, false
+	}
+	precipitation, ok := parsed[c.PrecipitationField]
+	if !ok {
+		return 0, false
+	}
+	if !c.isSnow(precipitationType) {
+		return 0, true
+	}
+	return precipitation * inchToMm, true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// sourceIpRaw, sourceIpHashed, and sourceIpOmit are the ways the source ip can appear in the source_ip label: as
+	// is, as a stable hash, or not at all.
+	sourceIpRaw    = "raw"
+	sourceIpHashed = "hashed"
+	sourceIpOmit   = "omit"
+
+	// sourceIpHashLength is the number of hex characters of the sha256 hash kept in the hashed source_ip label.
+	sourceIpHashLength = 16
+)
+
+// hashSourceIp returns a truncated sha256 hash of the source ip so that the same ip always maps to the same label
+// value without revealing it. The "unknown" placeholder is not hashed.
+func hashSourceIp(sourceIp string) string {
+	if sourceIp == "unknown" {
+		return sourceIp
+	}
+	sum := sha256.Sum256([]byte(sourceIp))
+	return hex.EncodeToString(sum[:])[:sourceIpHashLength]
+}
+
+// sourceIpResolver determines the ip address of the station that sent a request. The X-Real-IP and X-Forwarded-For
+// headers set by a reverse proxy are only believed when the request came from a trusted proxy.
+type sourceIpResolver struct {
+	// trustAll believes the forwarded headers of every request, used when no trusted proxies are configured.
+	trustAll bool
+	trusted  []*net.IPNet
+}
+
+// newSourceIpResolver parses the trusted proxies, each either an ip address or a cidr range. A nil list trusts every
+// peer while an empty list trusts none.
+func newSourceIpResolver(trustedProxies []string) (*sourceIpResolver, error) {
+	trusted, err := parseNetworks("trusted proxy", trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceIpResolver{trustAll: trustedProxies == nil, trusted: trusted}, nil
+}
+
+// parseNetworks parses a list of entries that are each either an ip address or a cidr range, with a single address
+// becoming the range containing only itself. The kind describes the entries in errors.
+func parseNetworks(kind string, entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s '%s': not an ip address or cidr range", kind, entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s': %w", kind, entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// networksContain returns whether the ip address is in any of the networks.
+func networksContain(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the source ip of the request. The X-Real-IP header is preferred, then the first hop of the
+// X-Forwarded-For header which is the original client, and finally the address of the peer itself.
+func (r *sourceIpResolver) resolve(request *http.Request) string {
+	return r.resolveFrom(request, r.trusts(stripPort(request.RemoteAddr)))
+}
+
+// resolveVerified returns the source ip of the request like resolve, except that the forwarded headers are only
+// believed from an explicitly configured trusted proxy. Without trusted proxies any client could claim to be any
+// address, so this is the address that access control and rate limiting use.
+func (r *sourceIpResolver) resolveVerified(request *http.Request) string {
+	peer := stripPort(request.RemoteAddr)
+	return r.resolveFrom(request, !r.trustAll && r.trusts(peer))
+}
+
+// resolveFrom returns the source ip of the request, taken from the forwarded headers only when they are believed.
+func (r *sourceIpResolver) resolveFrom(request *http.Request, believeHeaders bool) string {
+	peer := stripPort(request.RemoteAddr)
+	if believeHeaders {
+		if ip := strings.TrimSpace(request.Header.Get("X-Real-IP")); ip != "" {
+			return stripPort(ip)
+		}
+		if forwarded := request.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return stripPort(ip)
+			}
+		}
+	}
+	if peer == "" {
+		return "unknown"
+	}
+	return peer
+}
+
+func (r *sourceIpResolver) trusts(peer string) bool {
+	return r.trustAll || networksContain(r.trusted, peer)
+}
+
+// stripPort removes the port from an address if it has one, along with the brackets around an ipv6 address, so that
+// both "[::1]:8080" and "::1" become "::1".
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stationSummary is the latest state of a station as shown by the stations endpoint.
+type stationSummary struct {
+	Labels     map[string]string  `json:"labels"`
+	LastReport time.Time          `json:"lastReport"`
+	Values     map[string]float64 `json:"values"`
+}
+
+// stations summarises the gauges currently held for each station, keyed by gauge name. Gauges with labels beyond the
+// station labels are keyed by the name followed by the extra labels, for example temp_celsius{channel="outdoor"}.
+func (m *relayMetrics) stations() []stationSummary {
+	byStation := make(map[string]*stationSummary)
+	for _, series := range m.gauges.snapshot() {
+		station := make(map[string]string, len(m.stationLabelNames))
+		for _, name := range m.stationLabelNames {
+			station[name] = series.labels[name]
+		}
+		var extra []string
+		for _, name := range sortedLabelNames(series.labels) {
+			if _, isStation := station[name]; !isStation && name != measurementLabel {
+				extra = append(extra, fmt.Sprintf("%s=%q", name, series.labels[name]))
+			}
+		}
+		key := series.measurement
+		if len(extra) > 0 {
+			key += "{" + strings.Join(extra, ",") + "}"
+		}
+
+		id := seriesKey("", station)
+		summary, ok := byStation[id]
+		if !ok {
+			summary = &stationSummary{Labels: station, Values: make(map[string]float64)}
+			byStation[id] = summary
+		}
+		summary.Values[key] = series.value
+		if series.lastUpdated.After(summary.LastReport) {
+			summary.LastReport = series.lastUpdated
+		}
+	}
+
+	ids := make([]string, 0, len(byStation))
+	for id := range byStation {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	summaries := make([]stationSummary, 0, len(ids))
+	for _, id := range ids {
+		summaries = append(summaries, *byStation[id])
+	}
+	return summaries
+}
+
+// stationsHandler serves the station summaries as a json array.
+func (m *relayMetrics) stationsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			writer.Header().Set("Allow", http.MethodGet)
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		encoded, err := json.Marshal(m.stations())
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		_, _ = writer.Write(encoded)
+	})
+}
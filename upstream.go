@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// upstreamTimeout bounds how long replaying a single report to the upstream may take.
+	upstreamTimeout = 30 * time.Second
+
+	upstreamResultSuccess = "success"
+	upstreamResultFailure = "failure"
+	upstreamResultDropped = "dropped"
+)
+
+// upstreamSkippedHeaders are the request headers that are not replayed to the upstream, either because they describe
+// the connection to the relay or because the body is replayed after it was decompressed.
+var upstreamSkippedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// upstreamRequest is the body and headers of a report as the station sent it.
+type upstreamRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// upstreamForwarder replays the reports posted by stations to the upstream url, normally the ecowitt.net service, so
+// that the stations keep appearing in the Ecowitt app. Reports are replayed from a bounded queue by a single routine
+// so that the station never waits on the upstream. Failed replays are counted and not retried since the station sends
+// newer values with its next report.
+type upstreamForwarder struct {
+	url string
+	// redactedUrl is the url with any password removed so that it can be logged.
+	redactedUrl string
+	client      *http.Client
+	metrics     *relayMetrics
+	queue       chan upstreamRequest
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func newUpstreamForwarder(rawUrl string, metrics *relayMetrics) *upstreamForwarder {
+	f := &upstreamForwarder{
+		url:         rawUrl,
+		redactedUrl: redactUrl(rawUrl),
+		client:      &http.Client{Timeout: upstreamTimeout},
+		metrics:     metrics,
+		queue:       make(chan upstreamRequest, forwardQueueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// forward queues the report without blocking, dropping it if the queue is full because the upstream is slow.
+func (f *upstreamForwarder) forward(header http.Header, body []byte) {
+	select {
+	case f.queue <- upstreamRequest{header: header.Clone(), body: body}:
+	default:
+		zap.S().Warnw("upstream queue is full, dropping the report", "url", f.redactedUrl)
+		f.metrics.addUpstreamForwards(upstreamResultDropped, 1)
+	}
+}
+
+// close stops the background routine, discarding any reports still queued.
+func (f *upstreamForwarder) close() {
+	close(f.stop)
+	<-f.done
+	if n := len(f.queue); n > 0 {
+		zap.S().Warnw("discarding queued upstream reports on shutdown", "url", f.redactedUrl, "reports", n)
+		f.metrics.addUpstreamForwards(upstreamResultDropped, n)
+	}
+}
+
+func (f *upstreamForwarder) run() {
+	defer close(f.done)
+	for {
+		select {
+		case <-f.stop:
+			return
+		case r := <-f.queue:
+			if err := f.send(r); err != nil {
+				zap.S().Warnw("failed to forward report upstream", "url", f.redactedUrl, "err", err)
+				f.metrics.addUpstreamForwards(upstreamResultFailure, 1)
+				continue
+			}
+			f.metrics.addUpstreamForwards(upstreamResultSuccess, 1)
+		}
+	}
+}
+
+func (f *upstreamForwarder) send(r upstreamRequest) error {
+	req, err := http.NewRequest(http.MethodPost, f.url, bytes.NewReader(r.body))
+	if err != nil {
+		return err
+	}
+	for name, values := range r.header {
+		if !upstreamSkippedHeaders[http.CanonicalHeaderKey(name)] {
+			req.Header[name] = values
+		}
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so that the connection can be reused for the next report
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import "net/url"
+
+// wundergroundPath is the path that stations using the Weather Underground protocol upload to.
+const wundergroundPath = "/weatherstation/updateweatherstation.php"
+
+// wundergroundFields maps the Weather Underground field names that differ from the ecowitt protocol to their ecowitt
+// equivalent. The ID takes the place of the PASSKEY so that it can be used in allowedPasskeys and stationNames.
+var wundergroundFields = map[string]string{
+	"ID":             "PASSKEY",
+	"softwaretype":   "stationtype",
+	"rainin":         "hourlyrainin",
+	"baromin":        "baromrelin",
+	"absbaromin":     "baromabsin",
+	"UV":             "uv",
+	"indoortempf":    "tempinf",
+	"indoorhumidity": "humidityin",
+}
+
+// wundergroundIgnoredFields are the Weather Underground fields that are not measurements. The PASSWORD is a secret
+// that must never be exposed as a metric.
+var wundergroundIgnoredFields = []string{"PASSWORD", "action", "realtime", "rtfreq"}
+
+// fromWunderground converts the query parameters of a Weather Underground upload into the equivalent ecowitt report
+// fields. Fields without a mapping are passed through unchanged since most names are shared by both protocols.
+func fromWunderground(query url.Values) url.Values {
+	values := make(url.Values, len(query))
+	for key, value := range query {
+		if name, ok := wundergroundFields[key]; ok {
+			key = name
+		}
+		values[key] = append(values[key], value...)
+	}
+	for _, key := range wundergroundIgnoredFields {
+		values.Del(key)
+	}
+	return values
+}